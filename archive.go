@@ -0,0 +1,173 @@
+package spotmc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/goura/spotmc/archiver"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hashCounter measures a stream passing through it.
+type hashCounter struct {
+	h hash.Hash
+	n int64
+}
+
+func newHashCounter() *hashCounter {
+	return &hashCounter{h: sha256.New()}
+}
+
+func (hc *hashCounter) Write(p []byte) (int, error) {
+	hc.h.Write(p)
+	hc.n += int64(len(p))
+	return len(p), nil
+}
+
+func (hc *hashCounter) Sum() string {
+	return hex.EncodeToString(hc.h.Sum(nil))
+}
+
+// How often a long archiving or extraction logs how far it is
+var ARCHIVE_PROGRESS_INTERVAL = 10 * time.Second
+
+// archiveProgress returns an archiver.Options.Progress which logs msg
+// with the files and bytes done so far, every ARCHIVE_PROGRESS_INTERVAL.
+func archiveProgress(msg string) func(p archiver.Progress) {
+	last := time.Now()
+	return func(p archiver.Progress) {
+		if time.Since(last) < ARCHIVE_PROGRESS_INTERVAL {
+			return
+		}
+		last = time.Now()
+		log.WithFields(log.Fields{
+			"files": p.Files,
+			"bytes": p.Bytes,
+			"path":  p.Name,
+		}).Info(msg)
+	}
+}
+
+// archiveWarning logs a file which changed while the data was archived,
+// as the game server keeps writing during a hot backup.
+func archiveWarning(name string, err error) {
+	log.WithFields(log.Fields{"path": name, "err": err}).Warn("file changed while archiving")
+}
+
+// archiveUsage is what a top-level entry of the data dir adds to the
+// saved data. Files directly in the data dir count as ".".
+type archiveUsage struct {
+	Name          string
+	Files         int
+	Bytes         int64
+	ExcludedBytes int64
+}
+
+// planArchive walks dir as archiving it with filter would, calls each for
+// every regular file archived, and returns the usage per top-level entry.
+func planArchive(dir string, filter func(name string, dir bool) bool, each func(name string, size int64)) ([]*archiveUsage, error) {
+	usage := map[string]*archiveUsage{}
+	top := func(name string, dir bool) *archiveUsage {
+		t := name
+		if i := strings.Index(name, "/"); i > 0 {
+			t = name[:i]
+		} else if !dir {
+			t = "."
+		}
+		if usage[t] == nil {
+			usage[t] = &archiveUsage{Name: t}
+		}
+		return usage[t]
+	}
+
+	err := filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		u := top(name, fi.IsDir())
+		if !filter(name, fi.IsDir()) {
+			if !fi.IsDir() {
+				u.ExcludedBytes += fi.Size()
+				return nil
+			}
+			n, err := dirSize(fpath)
+			u.ExcludedBytes += n
+			if err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() {
+			u.Files++
+			u.Bytes += fi.Size()
+			each(name, fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for t := range usage {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	var list []*archiveUsage
+	for _, t := range names {
+		list = append(list, usage[t])
+	}
+	return list, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var n int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n += fi.Size()
+		}
+		return err
+	})
+	return n, err
+}
+
+// ArchiveDryRun lists what saving the data dir would archive, with the
+// current game, SPOTMC_PERSIST_PATHS, SPOTMC_ARCHIVE_EXCLUDES and
+// .spotmcignore, followed by the size per top-level directory.
+func ArchiveDryRun(dir string, w io.Writer) error {
+	smc, err := NewSpotMC()
+	if err != nil {
+		return err
+	}
+	smc.dataDirPath = dir
+	usage, err := planArchive(dir, smc.archiveFilter(), func(name string, size int64) {
+		fmt.Fprintf(w, "%d\t%s\n", size, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "bytes\tfiles\texcluded\tdirectory\n")
+	var total archiveUsage
+	for _, u := range usage {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", u.Bytes, u.Files, u.ExcludedBytes, u.Name)
+		total.Bytes += u.Bytes
+		total.Files += u.Files
+		total.ExcludedBytes += u.ExcludedBytes
+	}
+	fmt.Fprintf(w, "%d\t%d\t%d\ttotal\n", total.Bytes, total.Files, total.ExcludedBytes)
+	return nil
+}
@@ -0,0 +1,72 @@
+package spotmc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanArchive(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	for name, content := range map[string]string{
+		"server.properties":          "motd=hi",
+		"world/level.dat":            "level",
+		"world/region/r.0.0.mca":     "region",
+		"logs/latest.log":            "log",
+		"libraries/lib.jar":          "library",
+		"plugins/Essentials.jar":     "plugin",
+		"plugins/dynmap/web/tiles/a": "tile",
+		ARCHIVE_IGNORE_FILE:          "# backups are elsewhere\n/world/region/\n",
+	} {
+		p := filepath.Join(dataDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		ioutil.WriteFile(p, []byte(content), 0644)
+	}
+
+	smc := &SpotMC{excludes: minecraftExcludes, dataDirPath: dataDir}
+	archived := map[string]int64{}
+	usage, err := planArchive(dataDir, smc.archiveFilter(), func(name string, size int64) {
+		archived[name] = size
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{
+		"server.properties":      7,
+		ARCHIVE_IGNORE_FILE:      39,
+		"world/level.dat":        5,
+		"plugins/Essentials.jar": 6,
+	}
+	if len(archived) != len(expected) {
+		t.Errorf("got %v", archived)
+	}
+	for name, size := range expected {
+		if archived[name] != size {
+			t.Errorf("%s: got %d bytes, expected %d", name, archived[name], size)
+		}
+	}
+
+	got := map[string]archiveUsage{}
+	for _, u := range usage {
+		got[u.Name] = *u
+	}
+	for _, u := range []archiveUsage{
+		{".", 2, 46, 0},
+		{"libraries", 0, 0, 7},
+		{"logs", 0, 0, 3},
+		{"plugins", 1, 6, 4},
+		{"world", 1, 5, 6},
+	} {
+		if got[u.Name] != u {
+			t.Errorf("got %+v, expected %+v", got[u.Name], u)
+		}
+	}
+	if len(usage) != 5 {
+		t.Errorf("got %d entries", len(usage))
+	}
+}
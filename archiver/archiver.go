@@ -0,0 +1,558 @@
+// Package archiver streams a directory into a compressed tarball and
+// back, keeping modes and mtimes, and refusing archives which would
+// write outside of the target directory.
+package archiver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// What's not worth saving in any game server data dir: logs, caches and
+// crash reports, which are kept separately
+var DEFAULT_EXCLUDES = []string{"/logs/", "/cache/", "/crash-reports/"}
+
+// Options tells how to write or extract an archive.
+type Options struct {
+	// "zstd", "gzip" or "none". When extracting, "" detects it.
+	Compression string
+	// A negative level means the default level of the format
+	Level int
+	// gitignore-style patterns of paths to leave out, see Excluded
+	Excludes []string
+	// If set, only the paths it returns true for are written
+	Filter func(name string, dir bool) bool
+	// Called after each file
+	Progress func(p Progress)
+	// Called when a file changed while being archived, which doesn't
+	// fail Write. A file which vanished is left out, one which shrank is
+	// padded with zeros to the size it had.
+	Warn func(name string, err error)
+}
+
+// Progress tells how far an archive has been written or extracted.
+type Progress struct {
+	Files int
+	Bytes int64
+	Name  string
+}
+
+func (o *Options) skip(name string, dir bool) bool {
+	if o.Filter != nil && !o.Filter(name, dir) {
+		return true
+	}
+	return Excluded(name, dir, o.Excludes)
+}
+
+func (o *Options) warn(name string, err error) {
+	if o.Warn != nil {
+		o.Warn(name, err)
+	}
+}
+
+func (o *Options) progress(p *Progress, name string, n int64) {
+	p.Files++
+	p.Bytes += n
+	p.Name = name
+	if o.Progress != nil {
+		o.Progress(*p)
+	}
+}
+
+// Excluded tells whether a slash separated path is left out by
+// gitignore-style patterns:
+//   - "*.tmp" matches a name at any depth, "/world/session.lock" or
+//     "world/*.tmp" match from the top
+//   - a trailing "/" only matches directories, and "**" matches any
+//     number of directories, like "plugins/**/tiles/"
+//   - "!" includes again what an earlier pattern excluded, as the last
+//     matching pattern wins
+//
+// Like git, nothing in an excluded directory can be included again.
+func Excluded(name string, dir bool, patterns []string) bool {
+	if i := strings.LastIndex(name, "/"); i > 0 && Excluded(name[:i], true, patterns) {
+		return true
+	}
+	excluded := false
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		include := strings.HasPrefix(p, "!")
+		if include {
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			if !dir {
+				continue
+			}
+			p = strings.TrimSuffix(p, "/")
+		}
+		target := name
+		if strings.Contains(p, "/") {
+			p = strings.TrimPrefix(p, "/")
+		} else {
+			target = path.Base(name)
+		}
+		if matchSegments(strings.Split(p, "/"), strings.Split(target, "/")) {
+			excluded = !include
+		}
+	}
+	return excluded
+}
+
+// matchSegments matches path segments, "**" matching any number of them.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Write streams dir as a compressed tarball into w.
+// It returns the SHA-256 of every regular file it archived.
+func Write(w io.Writer, dir string, opts Options) (files map[string]string, err error) {
+	cw, err := newCompressWriter(w, opts.Compression, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(cw)
+	files = map[string]string{}
+	var p Progress
+
+	err = filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(dir, fpath)
+		if relErr != nil {
+			return relErr
+		}
+		name := filepath.ToSlash(rel)
+		if os.IsNotExist(err) && rel != "." {
+			opts.warn(name, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if opts.skip(name, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var f *os.File
+		if fi.Mode().IsRegular() {
+			f, err = os.Open(fpath)
+			if os.IsNotExist(err) {
+				opts.warn(name, err)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			// The size when opened is closer to what's read
+			fi, err = f.Stat()
+			if err != nil {
+				return err
+			}
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(fpath)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || f == nil {
+			return err
+		}
+
+		// A file which grows meanwhile is cut to the size in the header,
+		// and one which shrinks is padded to it
+		h := sha256.New()
+		tee := io.MultiWriter(tw, h)
+		n, err := copyPadded(tee, f, hdr.Size)
+		if n < hdr.Size && err == nil {
+			opts.warn(name, fmt.Errorf("shrank from %d to %d bytes while archiving", hdr.Size, n))
+		}
+		if err != nil {
+			return fmt.Errorf("archiving %s: %s", name, err)
+		}
+		files[name] = hex.EncodeToString(h.Sum(nil))
+		opts.progress(&p, name, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = cw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// copyPadded copies size bytes from r to w, padding with zeros what r
+// doesn't have. It returns how many bytes came from r.
+func copyPadded(w io.Writer, r io.Reader, size int64) (int64, error) {
+	n, err := io.CopyN(w, r, size)
+	if err == io.EOF {
+		_, err = io.CopyN(w, zeros{}, size-n)
+	}
+	return n, err
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Extract unpacks a tarball read from r into dir. Modes and mtimes are
+// restored. Entries which would end up outside of dir, by their name or
+// through a symlink, fail the extraction.
+func Extract(r io.Reader, dir string, opts Options) error {
+	dir = filepath.Clean(dir)
+	cr, err := newDecompressReader(r, opts.Compression)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	tr := tar.NewReader(cr)
+	var p Progress
+	dirs := map[string]*tar.Header{}
+	links := map[string]string{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(hdr.Name, "/")
+		if opts.skip(name, hdr.Typeflag == tar.TypeDir) {
+			continue
+		}
+
+		target, err := SafeJoin(dir, hdr.Name)
+		if err == nil {
+			err = checkParents(dir, target)
+		}
+		if err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+			// Set once its content is in place
+			dirs[target] = hdr
+		case tar.TypeReg, tar.TypeRegA:
+			var n int64
+			n, err = extractFile(tr, dir, target, mode.Perm(), hdr.ModTime)
+			if err == nil {
+				opts.progress(&p, name, n)
+			}
+		case tar.TypeSymlink:
+			err = CheckSymlink(dir, target, hdr.Linkname)
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(target), 0755)
+			}
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+			links[target] = hdr.Linkname
+		default:
+			// Devices, fifos and such have no place in game data
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// A later entry may have made an earlier link lead out of dir
+	err = CheckSymlinks(dir, links)
+	if err != nil {
+		return err
+	}
+
+	for target, hdr := range dirs {
+		err = os.Chmod(target, hdr.FileInfo().Mode().Perm())
+		if err == nil {
+			err = os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractZip unpacks a zip file into dir, with the same guards as
+// Extract. Filter and Excludes in opts leave entries out.
+func ExtractZip(file, dir string, opts Options) error {
+	dir = filepath.Clean(dir)
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	var p Progress
+
+	for _, f := range zr.File {
+		name := strings.TrimSuffix(f.Name, "/")
+		mode := f.Mode()
+		if opts.skip(name, mode.IsDir()) {
+			continue
+		}
+		target, err := SafeJoin(dir, f.Name)
+		if err == nil {
+			err = checkParents(dir, target)
+		}
+		if err != nil {
+			return err
+		}
+		if mode.IsDir() {
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		perm := mode.Perm()
+		if perm == 0 {
+			perm = 0644
+		}
+		n, err := extractFile(r, dir, target, perm, f.Modified)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		opts.progress(&p, name, n)
+	}
+	return nil
+}
+
+// CheckSymlinks checks again the symlinks created in dir, by target,
+// once all are in place, and removes those leading out of dir.
+func CheckSymlinks(dir string, links map[string]string) error {
+	var firstErr error
+	for target, link := range links {
+		err := CheckSymlink(dir, target, link)
+		if err != nil {
+			os.Remove(target)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// SafeJoin resolves a slash separated name from an archive inside dir,
+// refusing names which would end up outside of it.
+func SafeJoin(dir, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if !within(dir, target) {
+		return "", fmt.Errorf("archive entry escapes the directory: %s", name)
+	}
+	return target, nil
+}
+
+func within(dir, target string) bool {
+	return target == dir || strings.HasPrefix(target, dir+string(filepath.Separator))
+}
+
+// checkParents refuses to write target through a symlink, which an
+// earlier entry could have pointed anywhere.
+func checkParents(dir, target string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	p := dir
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, c)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry is below a symlink: %s", target)
+		}
+	}
+	return nil
+}
+
+// CheckSymlink refuses a symlink at target, in dir, which points
+// outside of dir. The link is resolved through the symlinks already in
+// dir, so a chain of links can't lead out either.
+func CheckSymlink(dir, target, link string) error {
+	bad := fmt.Errorf("archive symlink points outside of the directory: %s -> %s", target, link)
+	if filepath.IsAbs(link) || !within(dir, filepath.Join(filepath.Dir(target), link)) {
+		return bad
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(dir, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveIn(realDir, filepath.ToSlash(rel)+"/"+filepath.ToSlash(link), 0)
+	if err != nil || !within(realDir, resolved) {
+		return bad
+	}
+	return nil
+}
+
+// How many symlinks resolveIn follows before giving up, like the kernel
+var maxSymlinks = 40
+
+// resolveIn resolves a slash separated relative path from base like the
+// kernel would, following the symlinks which exist. ".." is applied to
+// what a symlink points to, not to its name. Components which don't
+// exist yet are taken as they are.
+func resolveIn(base, rel string, links int) (string, error) {
+	cur := base
+	for _, c := range strings.Split(rel, "/") {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+		next := filepath.Join(cur, c)
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		if links >= maxSymlinks {
+			return "", fmt.Errorf("too many levels of symlinks: %s", next)
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			cur, err = resolveIn("/", filepath.ToSlash(link), links+1)
+		} else {
+			cur, err = resolveIn(cur, filepath.ToSlash(link), links+1)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return cur, nil
+}
+
+// OpenFile creates or truncates target, inside dir, for writing. It
+// refuses to write through a symlink, either at target or at one of the
+// directories between dir and target, which an archive could have
+// pointed anywhere.
+func OpenFile(dir, target string, perm os.FileMode) (*os.File, error) {
+	dir = filepath.Clean(dir)
+	if !within(dir, target) {
+		return nil, fmt.Errorf("path escapes the directory: %s", target)
+	}
+	err := checkParents(dir, target)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("refusing to write through a symlink: %s", target)
+	}
+	// O_NOFOLLOW in case one appeared since
+	return os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, perm)
+}
+
+func extractFile(r io.Reader, dir, target string, perm os.FileMode, mtime time.Time) (int64, error) {
+	f, err := OpenFile(dir, target, perm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	err = f.Close()
+	if err != nil {
+		return n, err
+	}
+	// The umask may have narrowed the mode
+	err = os.Chmod(target, perm)
+	if err == nil && !mtime.IsZero() {
+		err = os.Chtimes(target, mtime, mtime)
+	}
+	return n, err
+}
@@ -0,0 +1,296 @@
+package archiver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteExtract(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	mtime := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	os.MkdirAll(filepath.Join(src, "world/region"), 0755)
+	os.MkdirAll(filepath.Join(src, "logs"), 0755)
+	os.MkdirAll(filepath.Join(src, "cache"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "world/region/r.0.0.mca"), []byte("region"), 0600)
+	ioutil.WriteFile(filepath.Join(src, "start.sh"), []byte("#!/bin/sh"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "logs/latest.log"), []byte("log"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "cache/mojang.jar"), []byte("jar"), 0644)
+	os.Chtimes(filepath.Join(src, "world/region/r.0.0.mca"), mtime, mtime)
+	os.Symlink("world/region", filepath.Join(src, "region"))
+
+	for _, compression := range []string{"zstd", "gzip", "none"} {
+		var progress []Progress
+		var buf bytes.Buffer
+		files, err := Write(&buf, src, Options{
+			Compression: compression,
+			Level:       -1,
+			Excludes:    DEFAULT_EXCLUDES,
+			Progress:    func(p Progress) { progress = append(progress, p) },
+		})
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+		if len(files) != 2 || files["world/region/r.0.0.mca"] == "" || files["start.sh"] == "" {
+			t.Errorf("%s: got %v", compression, files)
+		}
+		if len(progress) != 2 || progress[1].Files != 2 || progress[1].Bytes != 15 {
+			t.Errorf("%s: got progress %v", compression, progress)
+		}
+
+		dst, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		err = Extract(&buf, dst, Options{})
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+		fi, err := os.Stat(filepath.Join(dst, "world/region/r.0.0.mca"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: got mode %s, mtime %s", compression, fi.Mode(), fi.ModTime())
+		}
+		fi, err = os.Stat(filepath.Join(dst, "start.sh"))
+		if err != nil || fi.Mode().Perm() != 0755 {
+			t.Errorf("%s: start.sh isn't executable: %v", compression, err)
+		}
+		if link, _ := os.Readlink(filepath.Join(dst, "region")); link != "world/region" {
+			t.Errorf("%s: got symlink %q", compression, link)
+		}
+		for _, name := range []string{"logs", "cache"} {
+			if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+				t.Errorf("%s: %s wasn't excluded", compression, name)
+			}
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	patterns := []string{
+		"# comment",
+		"/logs/",
+		"*.tmp",
+		"!keep.tmp",
+		"/world/session.lock",
+		"plugins/**/tiles/",
+		"/config/*",
+		"!/config/game.yml",
+		"!/logs/latest.log",
+	}
+	for _, c := range []struct {
+		name     string
+		dir      bool
+		expected bool
+	}{
+		{"logs", true, true},
+		{"logs", false, false},
+		{"logs/old.log", false, true},
+		// An excluded directory can't be included again
+		{"logs/latest.log", false, true},
+		{"world/logs", true, false},
+		{"a.tmp", false, true},
+		{"world/a.tmp", false, true},
+		{"world/keep.tmp", false, false},
+		{"world/session.lock", false, true},
+		{"nether/world/session.lock", false, false},
+		{"world", true, false},
+		{"plugins/tiles", true, true},
+		{"plugins/dynmap/web/tiles", true, true},
+		{"plugins/dynmap/web/tiles/0.png", false, true},
+		{"plugins/dynmap/web", true, false},
+		{"config/server.yml", false, true},
+		{"config/game.yml", false, false},
+	} {
+		if got := Excluded(c.name, c.dir, patterns); got != c.expected {
+			t.Errorf("%s (dir %v): got %v, expected %v", c.name, c.dir, got, c.expected)
+		}
+	}
+}
+
+func TestExtractRefusesEscapes(t *testing.T) {
+	for name, entries := range map[string][]tar.Header{
+		"traversal": {
+			{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"absolute symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		},
+		"relative symlink": {
+			{Name: "world/link", Typeflag: tar.TypeSymlink, Linkname: "../../outside"},
+		},
+		"through a symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "world"},
+			{Name: "link/level.dat", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"chained symlinks": {
+			{Name: "x/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "x/y/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "x/y/t", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "x/y/t/../escape"},
+			{Name: "s", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+		"symlinks made to escape later": {
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "x/y/t/../escape"},
+			{Name: "x/y/t", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		},
+		"write through a symlink": {
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "world"},
+			{Name: "s", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range entries {
+			hdr := hdr
+			tw.WriteHeader(&hdr)
+			if hdr.Size > 0 {
+				tw.Write([]byte("evil"))
+			}
+		}
+		tw.Close()
+
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		err = Extract(&buf, filepath.Join(dir, "data"), Options{Compression: "none"})
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "escape")); err == nil {
+			t.Errorf("%s: a file was written outside of the dir", name)
+		}
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zipPath := filepath.Join(dir, "server.zip")
+	writeZip := func(files map[string]string) {
+		f, err := os.Create(zipPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zw := zip.NewWriter(f)
+		for name, content := range files {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(content))
+		}
+		zw.Close()
+	}
+	dataDir := filepath.Join(dir, "data")
+
+	writeZip(map[string]string{"../escape": "evil"})
+	err = ExtractZip(zipPath, dataDir, Options{})
+	if err == nil {
+		t.Error("expected an error for an entry outside of the dir")
+	}
+
+	writeZip(map[string]string{"server": "binary", "logs/old.log": "log"})
+	err = ExtractZip(zipPath, dataDir, Options{Excludes: DEFAULT_EXCLUDES})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dataDir, "server")); string(data) != "binary" {
+		t.Errorf("got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "logs/old.log")); !os.IsNotExist(err) {
+		t.Error("logs/old.log wasn't excluded")
+	}
+}
+
+// A file changing under a hot backup doesn't fail it
+func TestWriteChangingFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	ioutil.WriteFile(filepath.Join(src, "a.json"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "b.json"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "c.json"), []byte("kept"), 0644)
+
+	var warned []string
+	var buf bytes.Buffer
+	files, err := Write(&buf, src, Options{
+		Compression: "none",
+		Filter: func(name string, dir bool) bool {
+			// Changed right after being listed
+			switch name {
+			case "a.json":
+				os.Truncate(filepath.Join(src, name), 4)
+			case "b.json":
+				os.Remove(filepath.Join(src, name))
+			}
+			return true
+		},
+		Warn: func(name string, err error) { warned = append(warned, name) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files["a.json"] == "" || files["c.json"] == "" {
+		t.Errorf("got %v", files)
+	}
+	if len(warned) != 1 || warned[0] != "b.json" {
+		t.Errorf("got warnings for %v", warned)
+	}
+}
+
+func TestCopyPadded(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := copyPadded(&buf, bytes.NewReader([]byte("abc")), 5)
+	if err != nil || n != 3 || buf.String() != "abc\x00\x00" {
+		t.Errorf("got %d, %q, %v", n, buf.String(), err)
+	}
+	buf.Reset()
+	n, err = copyPadded(&buf, bytes.NewReader([]byte("abcdef")), 5)
+	if err != nil || n != 5 || buf.String() != "abcde" {
+		t.Errorf("got %d, %q, %v", n, buf.String(), err)
+	}
+}
+
+func TestCheckLevel(t *testing.T) {
+	for _, c := range []struct {
+		format string
+		level  int
+		ok     bool
+	}{
+		{"gzip", -1, true},
+		{"gzip", 0, true},
+		{"gzip", 9, true},
+		{"gzip", 15, false},
+		{"zstd", -1, true},
+		{"zstd", 0, false},
+		{"zstd", 22, true},
+		{"zstd", 23, false},
+		{"none", 15, true},
+		{"lz4", 1, false},
+	} {
+		if err := CheckLevel(c.format, c.level); (err == nil) != c.ok {
+			t.Errorf("%s %d: got %v", c.format, c.level, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package archiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressWriter wraps w with the compression format.
+// A negative level means the default level of the format.
+func newCompressWriter(w io.Writer, format string, level int) (io.WriteCloser, error) {
+	switch format {
+	case "gzip":
+		if level < 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		opts := []zstd.EOption{}
+		if level >= 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case "none":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression format: %s", format)
+}
+
+// CheckLevel tells whether level is a compression level format accepts.
+// A negative level is the default of the format.
+func CheckLevel(format string, level int) error {
+	max := 0
+	switch format {
+	case "gzip":
+		max = gzip.BestCompression
+	case "zstd":
+		max = 22
+	case "none":
+		return nil
+	default:
+		return fmt.Errorf("unknown compression format: %s", format)
+	}
+	if level > max || (format == "zstd" && level == 0) {
+		return fmt.Errorf("%s compression level must be 1-%d: %d", format, max, level)
+	}
+	return nil
+}
+
+// sniffCompression guesses the compression format from the magic bytes.
+// Anything else is taken as a plain tarball.
+func sniffCompression(head []byte) string {
+	if bytes.HasPrefix(head, zstdMagic) {
+		return "zstd"
+	}
+	if bytes.HasPrefix(head, gzipMagic) {
+		return "gzip"
+	}
+	return "none"
+}
+
+// newDecompressReader undoes newCompressWriter.
+// If format is empty (snapshots saved before the manifest recorded it)
+// it's detected from the magic bytes, so old data.tgz keeps working.
+func newDecompressReader(r io.Reader, format string) (io.ReadCloser, error) {
+	if format == "" {
+		br := bufio.NewReader(r)
+		head, err := br.Peek(len(zstdMagic))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		format = sniffCompression(head)
+		r = br
+	}
+
+	switch format {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		// A single decoder goroutine, so nothing reads r after Close
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "none":
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression format: %s", format)
+}
@@ -2,6 +2,7 @@ package spotmc
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/service/autoscaling"
@@ -11,11 +12,61 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 var INSTANCE_ID_URL = "http://169.254.169.254/latest/meta-data/instance-id"
 
+// The metadata service answers right away on EC2, and not at all elsewhere
+var METADATA_TIMEOUT = 2 * time.Second
+var S3_PART_SIZE = 16 * 1024 * 1024
+var S3_UPLOAD_CONCURRENCY = 4
+
+// s3Objects is where the objects are read and written: archives, locks,
+// indexes, chunks, player lists and such. Tests replace it.
+var s3Objects s3Backend = awsS3{}
+
+type s3Backend interface {
+	GetStream(s3URLStr string) (body io.ReadCloser, etag string, err error)
+	HeadETag(s3URLStr string) (string, error)
+	PutBytes(s3URLStr string, data []byte) error
+	PutStream(s3URLStr string, r io.Reader) (etag string, err error)
+	Delete(s3URLStr string) error
+	List(s3PrefixURLStr string) ([]string, error)
+}
+
+// awsS3 is the s3Backend of the real S3.
+type awsS3 struct{}
+
+// S3GetStream opens the object for reading.
+// The caller must close the returned body.
+func S3GetStream(s3URLStr string) (body io.ReadCloser, etag string, err error) {
+	return s3Objects.GetStream(s3URLStr)
+}
+
+// S3HeadETag returns the current ETag of the object.
+// It returns an empty string without an error if the object doesn't exist.
+func S3HeadETag(s3URLStr string) (string, error) {
+	return s3Objects.HeadETag(s3URLStr)
+}
+
+// S3PutBytes writes data to the object, replacing it if it exists.
+func S3PutBytes(s3URLStr string, data []byte) error {
+	return s3Objects.PutBytes(s3URLStr, data)
+}
+
+func S3Delete(s3URLStr string) error {
+	return s3Objects.Delete(s3URLStr)
+}
+
+// S3List returns the keys under the prefix, relative to it.
+func S3List(s3PrefixURLStr string) ([]string, error) {
+	return s3Objects.List(s3PrefixURLStr)
+}
+
 func s3Client() *s3.S3 {
 	region := os.Getenv("SPOTMC_AWS_REGION")
 	if region == "" {
@@ -43,19 +94,26 @@ func parseS3URL(s3URLStr string) (bucket, key string, err error) {
 }
 
 func S3Put(s3URLStr, targetPath string) error {
+	_, err := S3PutETag(s3URLStr, targetPath)
+	return err
+}
+
+// S3PutETag is S3Put which also returns the ETag of the stored object.
+func S3PutETag(s3URLStr, targetPath string) (etag string, err error) {
 	bucket, key, err := parseS3URL(s3URLStr)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Open file
 	f, err := os.Open(targetPath)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer f.Close()
 	fi, err := os.Stat(targetPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Send request to S3
@@ -68,18 +126,23 @@ func S3Put(s3URLStr, targetPath string) error {
 	}
 
 	res, err := s3cli.PutObject(&req)
-	_ = res
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return stringValue(res.ETag), nil
 }
 
 func S3Get(s3URLStr, targetPath string) error {
+	_, err := S3GetETag(s3URLStr, targetPath)
+	return err
+}
+
+// S3GetETag is S3Get which also returns the ETag of the fetched object.
+func S3GetETag(s3URLStr, targetPath string) (etag string, err error) {
 	bucket, key, err := parseS3URL(s3URLStr)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Send request to S3
@@ -91,13 +154,14 @@ func S3Get(s3URLStr, targetPath string) error {
 
 	res, err := s3cli.GetObject(&req)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer res.Body.Close()
 
 	// Open target path
 	f, err := os.Create(targetPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer f.Close()
 	w := bufio.NewWriter(f)
@@ -105,12 +169,286 @@ func S3Get(s3URLStr, targetPath string) error {
 	// Copy stream
 	nBytes, err := io.Copy(w, res.Body)
 	_ = nBytes
+	if err != nil {
+		return "", err
+	}
+	err = w.Flush()
+	if err != nil {
+		return "", err
+	}
+
+	return stringValue(res.ETag), nil
+}
+
+// GetStream opens the object for reading.
+// The caller must close the returned body.
+func (awsS3) GetStream(s3URLStr string) (body io.ReadCloser, etag string, err error) {
+	bucket, key, err := parseS3URL(s3URLStr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s3cli := s3Client()
+	req := s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	res, err := s3cli.GetObject(&req)
+	if err != nil {
+		return nil, "", err
+	}
+	return res.Body, stringValue(res.ETag), nil
+}
+
+// S3PutStream uploads everything read from r with a multipart upload,
+// so neither a temp file nor the length is needed beforehand.
+// Parts are uploaded concurrently and each part is retried AWS_RETRY times.
+// On failure the upload is aborted and the object is left untouched.
+func S3PutStream(s3URLStr string, r io.Reader) (etag string, err error) {
+	return s3Objects.PutStream(s3URLStr, r)
+}
+
+func (awsS3) PutStream(s3URLStr string, r io.Reader) (etag string, err error) {
+	bucket, key, err := parseS3URL(s3URLStr)
+	if err != nil {
+		return "", err
+	}
+
+	s3cli := s3Client()
+	cres, err := s3cli.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	uploadID := cres.UploadID
+
+	type part struct {
+		num  int64
+		data []byte
+	}
+	var (
+		mu        sync.Mutex
+		completed []*s3.CompletedPart
+		uploadErr error
+		wg        sync.WaitGroup
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr != nil
+	}
+
+	parts := make(chan part)
+	for i := 0; i < S3_UPLOAD_CONCURRENCY; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				if failed() {
+					continue
+				}
+				var pres *s3.UploadPartOutput
+				var perr error
+				for j := 0; j < AWS_RETRY; j++ {
+					pres, perr = s3cli.UploadPart(&s3.UploadPartInput{
+						Bucket:        aws.String(bucket),
+						Key:           aws.String(key),
+						UploadID:      uploadID,
+						PartNumber:    aws.Long(p.num),
+						Body:          bytes.NewReader(p.data),
+						ContentLength: aws.Long(int64(len(p.data))),
+					})
+					if perr == nil {
+						break
+					}
+				}
+
+				mu.Lock()
+				if perr != nil {
+					if uploadErr == nil {
+						uploadErr = fmt.Errorf("uploading part %d failed: %s", p.num, perr)
+					}
+				} else {
+					completed = append(completed, &s3.CompletedPart{
+						ETag:       pres.ETag,
+						PartNumber: aws.Long(p.num),
+					})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Cut the stream into parts. The last part may be smaller than
+	// the minimum part size, and an empty stream is sent as one empty part.
+	var readErr error
+	for num := int64(1); !failed(); num++ {
+		buf := make([]byte, S3_PART_SIZE)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || num == 1 {
+			parts <- part{num: num, data: buf[:n]}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if readErr == nil {
+		readErr = uploadErr
+	}
+	if readErr != nil {
+		s3cli.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadID: uploadID,
+		})
+		return "", readErr
+	}
+
+	sort.Sort(byPartNumber(completed))
+	res, err := s3cli.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadID:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return "", err
+	}
+	return stringValue(res.ETag), nil
+}
+
+type byPartNumber []*s3.CompletedPart
+
+func (a byPartNumber) Len() int           { return len(a) }
+func (a byPartNumber) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPartNumber) Less(i, j int) bool { return *a[i].PartNumber < *a[j].PartNumber }
+
+// HeadETag returns the current ETag of the object.
+// It returns an empty string without an error if the object doesn't exist.
+func (awsS3) HeadETag(s3URLStr string) (string, error) {
+	bucket, key, err := parseS3URL(s3URLStr)
+	if err != nil {
+		return "", err
+	}
+
+	s3cli := s3Client()
+	req := s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	res, err := s3cli.HeadObject(&req)
+	if err != nil {
+		if isS3NotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return stringValue(res.ETag), nil
+}
+
+// S3GetBytes reads a whole (small) object into memory.
+func S3GetBytes(s3URLStr string) ([]byte, error) {
+	body, _, err := S3GetStream(s3URLStr)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// PutBytes writes data to the object, replacing it if it exists.
+func (awsS3) PutBytes(s3URLStr string, data []byte) error {
+	bucket, key, err := parseS3URL(s3URLStr)
+	if err != nil {
+		return err
+	}
+
+	s3cli := s3Client()
+	req := s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Long(int64(len(data))),
+	}
+
+	_, err = s3cli.PutObject(&req)
+	return err
+}
+
+func (awsS3) Delete(s3URLStr string) error {
+	bucket, key, err := parseS3URL(s3URLStr)
 	if err != nil {
 		return err
 	}
-	w.Flush()
 
-	return nil
+	s3cli := s3Client()
+	req := s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	_, err = s3cli.DeleteObject(&req)
+	return err
+}
+
+// List returns the keys under the prefix, relative to it.
+func (awsS3) List(s3PrefixURLStr string) ([]string, error) {
+	bucket, prefix, err := parseS3URL(s3PrefixURLStr)
+	if err != nil {
+		return nil, err
+	}
+
+	s3cli := s3Client()
+	var keys []string
+	var marker *string
+	for {
+		res, err := s3cli.ListObjects(&s3.ListObjectsInput{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+			Marker: marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range res.Contents {
+			keys = append(keys, strings.TrimPrefix(stringValue(o.Key), prefix))
+		}
+		if res.IsTruncated == nil || !*res.IsTruncated || len(res.Contents) == 0 {
+			break
+		}
+		marker = res.NextMarker
+		if marker == nil {
+			marker = res.Contents[len(res.Contents)-1].Key
+		}
+	}
+	return keys, nil
+}
+
+func stringValue(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// isS3NotFound tells whether err means the object doesn't exist,
+// as opposed to a network or permission problem.
+func isS3NotFound(err error) bool {
+	if apiErr, ok := err.(*aws.APIError); ok {
+		return apiErr.StatusCode == 404 || apiErr.Code == "NoSuchKey"
+	}
+	return false
 }
 
 func autoScalingClient() *autoscaling.AutoScaling {
@@ -123,21 +461,30 @@ func autoScalingClient() *autoscaling.AutoScaling {
 	return asCli
 }
 
-func TerminateInstanceInAutoScalingGroup() error {
-	// Auto determine myself
-	resp, err := http.Get(INSTANCE_ID_URL)
+// InstanceID returns the EC2 instance ID of this machine from the meta-data.
+func InstanceID() (string, error) {
+	cli := http.Client{Timeout: METADATA_TIMEOUT}
+	resp, err := cli.Get(INSTANCE_ID_URL)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("could not get instance id")
+		return "", fmt.Errorf("could not get instance id")
 	}
 	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func TerminateInstanceInAutoScalingGroup() error {
+	// Auto determine myself
+	instanceID, err := InstanceID()
 	if err != nil {
 		return err
 	}
-	instanceID := string(buf)
 
 	// Terminate the instance and decrement desired capacity
 	req := autoscaling.TerminateInstanceInAutoScalingGroupInput{
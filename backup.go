@@ -0,0 +1,99 @@
+package spotmc
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+var DEFAULT_SAVE_TIMEOUT = 60
+
+// How long the console may take to acknowledge save-off and save-on,
+// and how many times save-on is tried
+var SAVE_TOGGLE_TIMEOUT = 10 * time.Second
+var SAVE_ON_RETRY = 3
+
+// What the game server logs on save-off, save-all and save-on, by newer
+// and older versions
+var saveOffLogPattern = regexp.MustCompile(`Automatic saving is now disabled|Turned off world auto-saving|Saving is already turned off`)
+var savedLogPattern = regexp.MustCompile(`Saved the game|Saved the world`)
+var saveOnLogPattern = regexp.MustCompile(`Automatic saving is now enabled|Turned on world auto-saving|Saving is already turned on`)
+
+// saveData() is the backup coordinator: it saves the data dir, and while
+// the game server runs it first has the profile make the data consistent,
+// see GameProfile.Snapshot. The caller holds saveMu.
+func (smc *SpotMC) saveData() error {
+	dir := smc.dataDirPath
+	if atomic.LoadInt32(&smc.serverPid) == 0 {
+		// It may not have become ready before it stopped
+		err := smc.setRconPassword(false)
+		if err != nil {
+			return err
+		}
+	} else {
+		if smc.profile.Snapshot != nil {
+			var done func()
+			var err error
+			dir, done, err = smc.profile.Snapshot(smc)
+			if err != nil {
+				return fmt.Errorf("preparing the data for a backup: %s", err)
+			}
+			defer done()
+		} else if smc.profile.SaveCommand != "" {
+			err := smc.consoleCommand(smc.profile.SaveCommand)
+			if err != nil {
+				return err
+			}
+			time.Sleep(BACKUP_SETTLE_TIME)
+		}
+	}
+	return smc.putDataDir(dir)
+}
+
+// minecraftSnapshot() turns autosave off and writes the world with
+// "save-all flush", so that no region file changes while the data dir is
+// archived. done turns autosave back on, as does any error on the way.
+func minecraftSnapshot(smc *SpotMC) (string, func(), error) {
+	_, err := smc.expectLine("save-off", saveOffLogPattern.MatchString, SAVE_TOGGLE_TIMEOUT)
+	if err != nil {
+		// It may have been turned off without telling
+		smc.minecraftSaveOn()
+		return "", nil, err
+	}
+
+	_, err = smc.expectLine("save-all flush", savedLogPattern.MatchString, smc.saveTimeoutDuration())
+	if err != nil {
+		smc.minecraftSaveOn()
+		return "", nil, err
+	}
+	log.Info("autosave is off and the world is written, backing up")
+	return smc.dataDirPath, smc.minecraftSaveOn, nil
+}
+
+// minecraftSaveOn() turns autosave back on, and tells someone if it
+// can't, as the world wouldn't be saved anymore.
+func (smc *SpotMC) minecraftSaveOn() {
+	var err error
+	for i := 0; i < SAVE_ON_RETRY; i++ {
+		_, err = smc.expectLine("save-on", saveOnLogPattern.MatchString, SAVE_TOGGLE_TIMEOUT)
+		if err == nil {
+			log.Info("autosave is on again")
+			return
+		}
+	}
+	if atomic.LoadInt32(&smc.serverPid) == 0 {
+		// Nothing left to save
+		return
+	}
+	smc.notify("save-on-failed", "turning autosave back on failed, the world isn't saved until the server restarts", log.Fields{
+		"err": err.Error(),
+	})
+}
+
+func (smc *SpotMC) saveTimeoutDuration() time.Duration {
+	smc.mu.Lock()
+	defer smc.mu.Unlock()
+	return time.Duration(smc.saveTimeout) * time.Second
+}
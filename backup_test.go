@@ -0,0 +1,142 @@
+package spotmc
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeConsole answers console commands like the game server would, in
+// the log, and records them. Commands not in answers get no answer.
+func fakeConsole(smc *SpotMC, answers map[string]string) (*[]string, *sync.Mutex) {
+	r, w := io.Pipe()
+	smc.console = w
+	smc.tail = newLogTail(10)
+	smc.serverPid = 1
+	var mu sync.Mutex
+	var got []string
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			mu.Lock()
+			got = append(got, s.Text())
+			mu.Unlock()
+			if a, ok := answers[s.Text()]; ok {
+				smc.tail.Write([]byte("[Server thread/INFO]: " + a + "\n"))
+			}
+		}
+	}()
+	return &got, &mu
+}
+
+func TestMinecraftSnapshot(t *testing.T) {
+	smc := &SpotMC{dataDirPath: "/data", saveTimeout: 1}
+	got, mu := fakeConsole(smc, map[string]string{
+		"save-off":       "Automatic saving is now disabled",
+		"save-all flush": "Saved the game",
+		"save-on":        "Automatic saving is now enabled",
+	})
+	dir, done, err := minecraftSnapshot(smc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "/data" {
+		t.Errorf("got %q", dir)
+	}
+	done()
+	mu.Lock()
+	expected := []string{"save-off", "save-all flush", "save-on"}
+	if !reflect.DeepEqual(*got, expected) {
+		t.Errorf("got %q, expected %q", *got, expected)
+	}
+	mu.Unlock()
+
+	// Saving is turned back on when the world isn't written in time
+	smc = &SpotMC{dataDirPath: "/data", saveTimeout: 1}
+	got, mu = fakeConsole(smc, map[string]string{
+		"save-off": "Automatic saving is now disabled",
+		"save-on":  "Automatic saving is now enabled",
+	})
+	_, _, err = minecraftSnapshot(smc)
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	mu.Lock()
+	expected = []string{"save-off", "save-all flush", "save-on"}
+	if !reflect.DeepEqual(*got, expected) {
+		t.Errorf("got %q, expected %q", *got, expected)
+	}
+	mu.Unlock()
+}
+
+func TestPutTgzDataDirConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "level.dat"), []byte("ours"), 0644)
+	url := "s3://bucket/data.tgz"
+
+	for _, c := range []struct {
+		name     string
+		remote   string // "" if there's no object
+		restored string // "" if nothing was restored
+		conflict bool
+	}{
+		{"matching etag", "theirs", "theirs", false},
+		{"mismatched etag", "theirs", "other", true},
+		{"first save", "", "", false},
+		{"missing object", "", "other", true},
+	} {
+		fake, restore := useFakeS3()
+		smc := &SpotMC{DataFileURL: url, envelope: &envelope{}, compression: "gzip", compressionLevel: -1}
+		if c.remote != "" {
+			fake.put(url, c.remote)
+		}
+		if c.restored != "" {
+			smc.dataETag = fakeETag([]byte(c.restored))
+		}
+
+		_, err := smc.putTgzDataDir(dir, smc.compression, smc.compressionLevel)
+		keys, _ := fake.List("s3://bucket/")
+		var conflicts []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, "data.tgz.conflict-") {
+				conflicts = append(conflicts, k)
+			}
+		}
+		if c.conflict {
+			if err != errSaveConflict {
+				t.Errorf("%s: got %v, expected a conflict", c.name, err)
+			}
+			if fake.get(url) != c.remote {
+				t.Errorf("%s: the data was overwritten", c.name)
+			}
+			// The archive and its manifest
+			if len(conflicts) != 2 {
+				t.Errorf("%s: got conflict snapshot %v", c.name, conflicts)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+			if fake.get(url) == c.remote || smc.dataETag != fakeETag([]byte(fake.get(url))) {
+				t.Errorf("%s: the data wasn't saved", c.name)
+			}
+			if m, _ := getManifest(url, smc.envelope); m == nil || m.ArchiveETag != smc.dataETag {
+				t.Errorf("%s: got manifest %v", c.name, m)
+			}
+			if len(conflicts) != 0 {
+				t.Errorf("%s: got conflict snapshot %v", c.name, conflicts)
+			}
+		}
+		restore()
+	}
+}
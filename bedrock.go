@@ -0,0 +1,268 @@
+package spotmc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/goura/spotmc/archiver"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where "bedrock:<version>" in SPOTMC_SERVER_URL is downloaded from
+var BEDROCK_DOWNLOAD_URL = "https://www.minecraft.net/bedrockdedicatedserver/bin-linux/bedrock-server-%s.zip"
+var DEFAULT_BEDROCK_PORT = 19132
+var BEDROCK_PING_TIMEOUT = 5 * time.Second
+
+// How often "save query" asks if the files are ready
+var BEDROCK_QUERY_INTERVAL = 2 * time.Second
+var BEDROCK_BACKUP_PREFIX = "bedrockbackup"
+
+// The offline message id of RakNet, in every unconnected packet
+var raknetMagic = []byte{
+	0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe,
+	0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78,
+}
+
+const (
+	raknetUnconnectedPing = 0x01
+	raknetUnconnectedPong = 0x1c
+)
+
+// serverDownloadURL resolves "bedrock:1.21.0.03" to the official
+// download. Other URLs are returned as is.
+func serverDownloadURL(url string) string {
+	if strings.HasPrefix(url, "bedrock:") {
+		return fmt.Sprintf(BEDROCK_DOWNLOAD_URL, strings.TrimPrefix(url, "bedrock:"))
+	}
+	return url
+}
+
+// bedrockStatus is what a Bedrock server tells in its unconnected pong.
+type bedrockStatus struct {
+	MOTD       string
+	Version    string
+	Players    int
+	MaxPlayers int
+}
+
+// bedrockPing sends a RakNet unconnected ping over UDP and returns the
+// status in the pong.
+func bedrockPing(addr string, timeout time.Duration) (*bedrockStatus, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var buf bytes.Buffer
+	buf.WriteByte(raknetUnconnectedPing)
+	binary.Write(&buf, binary.BigEndian, time.Now().UnixNano()/int64(time.Millisecond))
+	buf.Write(raknetMagic)
+	binary.Write(&buf, binary.BigEndian, rand.Int63())
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 1500)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return parseBedrockPong(resp[:n])
+}
+
+// parseBedrockPong reads an unconnected pong: the id, the time of the
+// ping, the server GUID, the magic and the status string like
+// "MCPE;Dedicated Server;618;1.20.51;0;10;<guid>;Bedrock level;Survival;1;19132;19133;".
+func parseBedrockPong(p []byte) (*bedrockStatus, error) {
+	if len(p) < 35 || p[0] != raknetUnconnectedPong || !bytes.Equal(p[17:33], raknetMagic) {
+		return nil, fmt.Errorf("not a raknet unconnected pong")
+	}
+	size := int(binary.BigEndian.Uint16(p[33:35]))
+	if len(p) < 35+size {
+		return nil, fmt.Errorf("truncated raknet unconnected pong")
+	}
+	fields := strings.Split(string(p[35:35+size]), ";")
+	if len(fields) < 6 {
+		return nil, fmt.Errorf("invalid bedrock server status: %q", p[35:35+size])
+	}
+	players, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid player count: %q", fields[4])
+	}
+	maxPlayers, _ := strconv.Atoi(fields[5])
+	return &bedrockStatus{
+		MOTD:       fields[1],
+		Version:    fields[3],
+		Players:    players,
+		MaxPlayers: maxPlayers,
+	}, nil
+}
+
+// bedrockPlayers() pings the server on the port in server.properties.
+func bedrockPlayers(smc *SpotMC) (int, error) {
+	port := DEFAULT_BEDROCK_PORT
+	f, err := os.Open(filepath.Join(smc.dataDirPath, "server.properties"))
+	if err == nil {
+		p, err := parseProperties(f)
+		f.Close()
+		if err == nil {
+			if v, ok := p.Get("server-port"); ok {
+				if i, err := strconv.Atoi(v); err == nil {
+					port = i
+				}
+			}
+		}
+	}
+	st, err := bedrockPing(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), BEDROCK_PING_TIMEOUT)
+	if err != nil {
+		return 0, err
+	}
+	return st.Players, nil
+}
+
+// parseSaveQuery reads the file list "save query" prints once the files
+// are ready, like "Bedrock level/db/000005.ldb:1234, Bedrock level/level.dat:2109".
+// The paths are relative to worlds/, and only the given length of each
+// file is part of the snapshot.
+func parseSaveQuery(line string) (map[string]int64, error) {
+	files := map[string]int64{}
+	for _, item := range strings.Split(strings.TrimSpace(line), ", ") {
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid save query entry: %q", item)
+		}
+		n, err := strconv.ParseInt(item[i+1:], 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid save query entry: %q", item)
+		}
+		files[item[:i]] = n
+	}
+	return files, nil
+}
+
+// bedrockSnapshot() holds saving with "save hold", copies the files
+// "save query" lists, cut to the listed lengths, into a temp dir along
+// with the settings, and resumes saving with "save resume". The game
+// keeps running all the while.
+func bedrockSnapshot(smc *SpotMC) (string, func(), error) {
+	err := smc.consoleCommand("save hold")
+	if err != nil {
+		return "", nil, err
+	}
+	// Whatever happens, the server must go on saving
+	defer func() {
+		err := smc.consoleCommand("save resume")
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("save resume failed")
+		}
+	}()
+
+	files, err := smc.bedrockSaveQuery()
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir(DATA_PATH_DIR, BEDROCK_BACKUP_PREFIX)
+	if err != nil {
+		return "", nil, err
+	}
+	done := func() { os.RemoveAll(dir) }
+	for name, n := range files {
+		src, err := archiver.SafeJoin(filepath.Join(smc.dataDirPath, "worlds"), name)
+		if err == nil {
+			dst := filepath.Join(dir, "worlds", filepath.FromSlash(name))
+			err = copyFilePrefix(src, dst, n)
+		}
+		if err != nil {
+			done()
+			return "", nil, err
+		}
+	}
+	// The settings aren't written by the server
+	for _, name := range bedrockConfigFiles {
+		src := filepath.Join(smc.dataDirPath, name)
+		fi, err := os.Stat(src)
+		if err != nil {
+			continue
+		}
+		err = copyFilePrefix(src, filepath.Join(dir, name), fi.Size())
+		if err != nil {
+			done()
+			return "", nil, err
+		}
+	}
+	log.WithFields(log.Fields{"files": len(files), "dir": dir}).Info("bedrock world copied for backup")
+	return dir, done, nil
+}
+
+// bedrockSaveQuery() asks "save query" until the files are ready and
+// returns the list. It gives up after SPOTMC_SAVE_TIMEOUT.
+func (smc *SpotMC) bedrockSaveQuery() (map[string]int64, error) {
+	timeout := smc.saveTimeoutDuration()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		ready := false
+		line, err := smc.expectLine("save query", func(line string) bool {
+			// The list comes on the line after this one
+			if ready {
+				return true
+			}
+			if strings.Contains(line, "Files are now ready to be copied") {
+				ready = true
+				return false
+			}
+			return strings.Contains(line, "previous save has not been completed")
+		}, BEDROCK_QUERY_INTERVAL*5)
+		if err != nil {
+			return nil, err
+		}
+		if ready {
+			return parseSaveQuery(line)
+		}
+		time.Sleep(BEDROCK_QUERY_INTERVAL)
+	}
+	return nil, fmt.Errorf("bedrock server didn't get the files ready in %s", timeout)
+}
+
+// copyFilePrefix copies the first n bytes of src to dst.
+func copyFilePrefix(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(out, in, n)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
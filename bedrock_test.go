@@ -0,0 +1,100 @@
+package spotmc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeBedrockServer answers unconnected pings like a Bedrock server
+// with the given status string.
+func fakeBedrockServer(t *testing.T, status string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n != 33 || buf[0] != raknetUnconnectedPing || !bytes.Equal(buf[9:25], raknetMagic) {
+				continue
+			}
+			var resp bytes.Buffer
+			resp.WriteByte(raknetUnconnectedPong)
+			resp.Write(buf[1:9])
+			binary.Write(&resp, binary.BigEndian, int64(42))
+			resp.Write(raknetMagic)
+			binary.Write(&resp, binary.BigEndian, uint16(len(status)))
+			resp.WriteString(status)
+			conn.WriteTo(resp.Bytes(), addr)
+		}
+	}()
+	return conn
+}
+
+func TestBedrockPing(t *testing.T) {
+	conn := fakeBedrockServer(t, "MCPE;Dedicated Server;618;1.20.51;3;10;42;Bedrock level;Survival;1;19132;19133;")
+	defer conn.Close()
+
+	st, err := bedrockPing(conn.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &bedrockStatus{MOTD: "Dedicated Server", Version: "1.20.51", Players: 3, MaxPlayers: 10}
+	if !reflect.DeepEqual(st, expected) {
+		t.Errorf("got %+v, expected %+v", st, expected)
+	}
+
+	_, err = parseBedrockPong([]byte{raknetUnconnectedPong, 1, 2, 3})
+	if err == nil {
+		t.Error("expected an error for a short packet")
+	}
+}
+
+func TestParseSaveQuery(t *testing.T) {
+	files, err := parseSaveQuery("Bedrock level/db/000005.ldb:1234, Bedrock level/db/CURRENT:16, Bedrock level/level.dat:2109\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{
+		"Bedrock level/db/000005.ldb": 1234,
+		"Bedrock level/db/CURRENT":    16,
+		"Bedrock level/level.dat":     2109,
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("got %v, expected %v", files, expected)
+	}
+	_, err = parseSaveQuery("Data saved. Files are now ready to be copied.")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestLogTailWatch(t *testing.T) {
+	tail := newLogTail(10)
+	ready := false
+	ch, cancel := tail.watch(func(line string) bool {
+		if ready {
+			return true
+		}
+		ready = line == "ready"
+		return false
+	})
+	defer cancel()
+	tail.Write([]byte("noise\nready\nthe list\nmore\n"))
+	select {
+	case line := <-ch:
+		if line != "the list" {
+			t.Errorf("got %q", line)
+		}
+	default:
+		t.Error("no line")
+	}
+}
@@ -0,0 +1,833 @@
+package spotmc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/goura/spotmc/archiver"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content defined chunking parameters.
+// Chunks are 64KiB-1MiB, 256KiB on average, so that a change in
+// a region file only re-uploads the chunks around it.
+var CHUNK_MIN_SIZE = 64 * 1024
+var CHUNK_AVG_BITS = uint(18)
+var CHUNK_MAX_SIZE = 1024 * 1024
+
+var CHUNK_STORE_SUFFIX = ".store/"
+
+// gearTable drives the rolling hash of the chunker.
+// It must never change, or chunk boundaries (and deduplication) would shift.
+var gearTable = newGearTable(0x73706f746d63)
+
+func newGearTable(seed uint64) (t [256]uint64) {
+	// splitmix64
+	x := seed
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}
+
+// splitChunks cuts data at content defined boundaries using a gear hash,
+// so that inserting or removing bytes only changes the chunks around the edit.
+func splitChunks(data []byte) [][]byte {
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.next()
+		if err != nil {
+			// Only io.EOF from a bytes.Reader
+			return chunks
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+// chunker cuts a stream at the same boundaries as splitChunks, holding
+// no more than two chunks in memory.
+type chunker struct {
+	r    io.Reader
+	buf  []byte
+	eof  bool
+	mask uint64
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:    r,
+		buf:  make([]byte, 0, 2*CHUNK_MAX_SIZE),
+		mask: ^uint64(0) << (64 - CHUNK_AVG_BITS),
+	}
+}
+
+// next returns the next chunk, or io.EOF after the last one.
+func (c *chunker) next() ([]byte, error) {
+	// The cut point depends on at most CHUNK_MAX_SIZE bytes
+	for len(c.buf) < CHUNK_MAX_SIZE && !c.eof {
+		n, err := c.r.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	n := chunkCutPoint(c.buf, c.mask)
+	chunk := append([]byte{}, c.buf[:n]...)
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	return chunk, nil
+}
+
+func chunkCutPoint(data []byte, mask uint64) int {
+	if len(data) <= CHUNK_MIN_SIZE {
+		return len(data)
+	}
+	max := len(data)
+	if max > CHUNK_MAX_SIZE {
+		max = CHUNK_MAX_SIZE
+	}
+	var h uint64
+	for i := CHUNK_MIN_SIZE; i < max; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&mask == 0 {
+			return i + 1
+		}
+	}
+	return max
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// indexEntry describes one file, directory or symlink of a snapshot.
+// Regular files are stored as a list of chunk hashes.
+type indexEntry struct {
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Chunks  []string    `json:"chunks,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	Reused  bool        `json:"-"`
+}
+
+// haveChunks tells whether the store has all of chunks.
+func haveChunks(existing map[string]bool, chunks []string) bool {
+	for _, sum := range chunks {
+		if !existing[sum] {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotIndex is the small per-snapshot object of the chunk store.
+type snapshotIndex struct {
+	ID            string       `json:"id"`
+	ChunkNaming   string       `json:"chunk_naming,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	ServerVersion string       `json:"server_version"`
+	World         string       `json:"world,omitempty"`
+	Files         []indexEntry `json:"files"`
+}
+
+// manifest() lets the index be verified like a tgz snapshot.
+func (idx *snapshotIndex) manifest() *manifest {
+	files := map[string]string{}
+	for _, e := range idx.Files {
+		if e.Mode.IsRegular() {
+			files[e.Path] = e.SHA256
+		}
+	}
+	return &manifest{
+		FileCount:     len(files),
+		Files:         files,
+		ServerVersion: idx.ServerVersion,
+		World:         idx.World,
+		CreatedAt:     idx.CreatedAt,
+	}
+}
+
+// chunkStore is a prefix on S3 laid out as:
+//
+//	chunks/{name}         chunk data, shared between snapshots
+//	snapshots/{id}.json   snapshot index
+//	latest                id of the snapshot to restore
+//	key                   secret chunks are named with, when encrypted
+//
+// Chunks, indexes and the key are encrypted when encryption is enabled.
+// Chunks are named by the SHA-256 of the plaintext, or when encrypted
+// by its HMAC with the key, so that the names don't tell whether a
+// known file (a vanilla region, a public map) is in the bucket.
+type chunkStore struct {
+	url     string
+	env     *envelope
+	world   string
+	nameKey []byte // set by save() and restore() when chunks are HMAC named
+}
+
+// How the chunks of an encrypted snapshot are named, see chunkName()
+var CHUNK_NAMING_HMAC = "hmac-sha256"
+
+// chunkName is the SHA-256 of data, or its HMAC-SHA256 if key is set.
+func chunkName(key, data []byte) string {
+	if key == nil {
+		return sha256Hex(data)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cs *chunkStore) keyURL() string {
+	return cs.url + "key"
+}
+
+// chunkKey returns the secret the chunks of an encrypted store are named
+// with, making one on the first save if create is set. It's sealed like
+// the data, so any key which opens the snapshots can use it.
+func (cs *chunkStore) chunkKey(create bool) ([]byte, error) {
+	data, err := S3GetBytes(cs.keyURL())
+	if err == nil {
+		return cs.env.open(data)
+	}
+	if !isS3NotFound(err) {
+		return nil, err
+	}
+	if !create {
+		return nil, fmt.Errorf("chunk store has no key: %s", cs.keyURL())
+	}
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := cs.env.seal(key)
+	if err != nil {
+		return nil, err
+	}
+	err = S3PutBytes(cs.keyURL(), sealed)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (cs *chunkStore) chunkURL(sum string) string {
+	return cs.url + "chunks/" + sum
+}
+
+func (cs *chunkStore) snapshotURL(id string) string {
+	return cs.url + "snapshots/" + id + ".json"
+}
+
+func (cs *chunkStore) latestURL() string {
+	return cs.url + "latest"
+}
+
+func (cs *chunkStore) listChunks() (map[string]bool, error) {
+	keys, err := S3List(cs.url + "chunks/")
+	if err != nil {
+		return nil, err
+	}
+	chunks := map[string]bool{}
+	for _, k := range keys {
+		chunks[k] = true
+	}
+	return chunks, nil
+}
+
+// listSnapshots returns snapshot IDs, oldest first.
+func (cs *chunkStore) listSnapshots() ([]string, error) {
+	keys, err := S3List(cs.url + "snapshots/")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, ".json") {
+			ids = append(ids, strings.TrimSuffix(k, ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (cs *chunkStore) getIndex(id string) (*snapshotIndex, error) {
+	data, err := S3GetBytes(cs.snapshotURL(id))
+	if err != nil {
+		return nil, err
+	}
+	data, err = cs.env.open(data)
+	if err != nil {
+		return nil, err
+	}
+	idx := &snapshotIndex{}
+	err = json.Unmarshal(data, idx)
+	if err != nil {
+		return nil, fmt.Errorf("broken snapshot index %s: %s", id, err)
+	}
+	return idx, nil
+}
+
+func (cs *chunkStore) putIndex(idx *snapshotIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	data, err = cs.env.seal(data)
+	if err != nil {
+		return err
+	}
+	return S3PutBytes(cs.snapshotURL(idx.ID), data)
+}
+
+// latest returns the ID and the ETag of the latest pointer,
+// or empty strings if nothing has been saved yet.
+func (cs *chunkStore) latest() (id, etag string, err error) {
+	body, etag, err := S3GetStream(cs.latestURL())
+	if err != nil {
+		if isS3NotFound(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(data)), etag, nil
+}
+
+func (cs *chunkStore) setLatest(id string) (etag string, err error) {
+	err = S3PutBytes(cs.latestURL(), []byte(id+"\n"))
+	if err != nil {
+		return "", err
+	}
+	return S3HeadETag(cs.latestURL())
+}
+
+// snapshotID names a snapshot by its time, down to the nanosecond so
+// that a backup and the final save in the same second don't collide.
+// IDs sort by time.
+func snapshotID(t time.Time) string {
+	return t.UTC().Format("20060102T150405.000000000Z")
+}
+
+func putBytesWithRetry(url string, data []byte) error {
+	var err error
+	for i := 0; i < AWS_RETRY; i++ {
+		err = S3PutBytes(url, data)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// save uploads the chunks of dir which the store doesn't have yet,
+// and then the snapshot index. It doesn't move the latest pointer.
+// Only the paths keep returns true for are saved, all if keep is nil.
+// Files with the size and mtime they have in prev aren't read again.
+// It returns the number of bytes uploaded.
+func (cs *chunkStore) save(dir, serverVersion string, keep func(name string, dir bool) bool, prev *snapshotIndex) (*snapshotIndex, int64, error) {
+	existing, err := cs.listChunks()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now().UTC()
+	idx := &snapshotIndex{
+		ID:            snapshotID(now),
+		CreatedAt:     now,
+		ServerVersion: serverVersion,
+		World:         cs.world,
+	}
+	if cs.env.enabled() {
+		cs.nameKey, err = cs.chunkKey(true)
+		if err != nil {
+			return nil, 0, err
+		}
+		idx.ChunkNaming = CHUNK_NAMING_HMAC
+	}
+	unchanged := map[string]indexEntry{}
+	if prev != nil && prev.ChunkNaming == idx.ChunkNaming {
+		for _, e := range prev.Files {
+			if e.Mode.IsRegular() {
+				unchanged[e.Path] = e
+			}
+		}
+	}
+
+	// The game server keeps writing during a hot backup, so a file
+	// which vanished is left out like archiver.Write does
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(dir, path)
+		if os.IsNotExist(err) {
+			archiveWarning(filepath.ToSlash(rel), err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if relErr != nil {
+			return relErr
+		}
+		if rel == "." {
+			return nil
+		}
+		if keep != nil && !keep(filepath.ToSlash(rel), fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := indexEntry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			e.Link, err = os.Readlink(path)
+			if os.IsNotExist(err) {
+				archiveWarning(e.Path, err)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if p, ok := unchanged[e.Path]; ok && fi.Mode().IsRegular() && p.Mode == e.Mode &&
+			p.Size == fi.Size() && p.ModTime.Equal(e.ModTime) && haveChunks(existing, p.Chunks) {
+			e = p
+			e.Reused = true
+		}
+		idx.Files = append(idx.Files, e)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		mu         sync.Mutex
+		firstErr   error
+		nUploaded  int
+		upBytes    int64
+		vanished   = map[string]bool{}
+		totalBytes int64
+		wg         sync.WaitGroup
+	)
+	files := make(chan *indexEntry)
+	for i := 0; i < S3_UPLOAD_CONCURRENCY; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range files {
+				err := cs.saveFile(e, dir, func(sum string, chunk []byte) error {
+					mu.Lock()
+					need := !existing[sum]
+					existing[sum] = true
+					mu.Unlock()
+					if !need {
+						return nil
+					}
+					sealed, err := cs.env.seal(chunk)
+					if err != nil {
+						return err
+					}
+					err = putBytesWithRetry(cs.chunkURL(sum), sealed)
+					if err != nil {
+						return err
+					}
+					mu.Lock()
+					nUploaded++
+					upBytes += int64(len(chunk))
+					mu.Unlock()
+					return nil
+				})
+
+				mu.Lock()
+				if os.IsNotExist(err) {
+					archiveWarning(e.Path, err)
+					vanished[e.Path] = true
+					err = nil
+				}
+				totalBytes += e.Size
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range idx.Files {
+		e := &idx.Files[i]
+		if e.Reused {
+			mu.Lock()
+			totalBytes += e.Size
+			mu.Unlock()
+		} else if e.Mode.IsRegular() {
+			files <- e
+		}
+	}
+	close(files)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	if len(vanished) > 0 {
+		kept := idx.Files[:0]
+		for _, e := range idx.Files {
+			if !vanished[e.Path] {
+				kept = append(kept, e)
+			}
+		}
+		idx.Files = kept
+	}
+
+	err = cs.putIndex(idx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"snapshot": idx.ID, "totalBytes": totalBytes,
+		"uploadedChunks": nUploaded, "uploadedBytes": upBytes,
+	}).Info("chunked snapshot saved")
+	return idx, upBytes, nil
+}
+
+// saveFile streams a file of dir through the chunker, calling put for
+// each chunk, and fills in its size, checksum and chunk list.
+func (cs *chunkStore) saveFile(e *indexEntry, dir string, put func(sum string, chunk []byte) error) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(e.Path)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	c := newChunker(io.TeeReader(f, h))
+	e.Size = 0
+	e.Chunks = nil
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum := chunkName(cs.nameKey, chunk)
+		e.Chunks = append(e.Chunks, sum)
+		e.Size += int64(len(chunk))
+		err = put(sum, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// restore writes the snapshot into dir, checking every chunk
+// and every file against its hash.
+func (cs *chunkStore) restore(idx *snapshotIndex, dir string) error {
+	switch idx.ChunkNaming {
+	case "":
+		cs.nameKey = nil
+	case CHUNK_NAMING_HMAC:
+		var err error
+		cs.nameKey, err = cs.chunkKey(false)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("snapshot %s: unknown chunk naming %q", idx.ID, idx.ChunkNaming)
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	files := make(chan indexEntry)
+	links := map[string]string{}
+	for i := 0; i < S3_UPLOAD_CONCURRENCY; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range files {
+				err := cs.restoreFile(e, dir)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, e := range idx.Files {
+		target, err := archiver.SafeJoin(dir, e.Path)
+		if err == nil {
+			switch {
+			case e.Mode.IsDir():
+				err = os.MkdirAll(target, e.Mode.Perm())
+			case e.Mode&os.ModeSymlink != 0:
+				err = archiver.CheckSymlink(dir, target, e.Link)
+				if err == nil {
+					err = os.MkdirAll(filepath.Dir(target), 0755)
+				}
+				if err == nil {
+					err = os.Symlink(e.Link, target)
+				}
+				links[target] = e.Link
+			case e.Mode.IsRegular():
+				files <- e
+			}
+		}
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+			break
+		}
+	}
+	close(files)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	// A later entry may have made an earlier link lead out of dir
+	return archiver.CheckSymlinks(dir, links)
+}
+
+func (cs *chunkStore) restoreFile(e indexEntry, dir string) error {
+	target, err := archiver.SafeJoin(dir, e.Path)
+	if err != nil {
+		return err
+	}
+	f, err := archiver.OpenFile(dir, target, e.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	for _, sum := range e.Chunks {
+		data, err := S3GetBytes(cs.chunkURL(sum))
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("fetching chunk %s of %s failed: %s", sum, e.Path, err)
+		}
+		data, err = cs.env.open(data)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("decrypting chunk %s of %s failed: %s", sum, e.Path, err)
+		}
+		if chunkName(cs.nameKey, data) != sum {
+			f.Close()
+			return fmt.Errorf("chunk %s of %s is corrupted", sum, e.Path)
+		}
+		h.Write(data)
+		_, err = f.Write(data)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.SHA256 {
+		return fmt.Errorf("restored %s doesn't match its checksum", e.Path)
+	}
+	return os.Chtimes(target, e.ModTime, e.ModTime)
+}
+
+// prune deletes all but the newest `retention` snapshots (never the
+// one marked latest), then deletes the chunks no remaining snapshot uses.
+func (cs *chunkStore) prune(retention int) error {
+	if retention <= 0 {
+		return nil
+	}
+	ids, err := cs.listSnapshots()
+	if err != nil {
+		return err
+	}
+	latestID, _, err := cs.latest()
+	if err != nil {
+		return err
+	}
+
+	var keep []string
+	for i, id := range ids {
+		if i < len(ids)-retention && id != latestID {
+			log.WithFields(log.Fields{"snapshot": id}).Info("deleting old snapshot")
+			err = S3Delete(cs.snapshotURL(id))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		keep = append(keep, id)
+	}
+
+	referenced := map[string]bool{}
+	for _, id := range keep {
+		idx, err := cs.getIndex(id)
+		if err != nil {
+			return err
+		}
+		for _, e := range idx.Files {
+			for _, sum := range e.Chunks {
+				referenced[sum] = true
+			}
+		}
+	}
+
+	chunks, err := cs.listChunks()
+	if err != nil {
+		return err
+	}
+	nDeleted := 0
+	for sum := range chunks {
+		if referenced[sum] {
+			continue
+		}
+		err = S3Delete(cs.chunkURL(sum))
+		if err != nil {
+			return err
+		}
+		nDeleted++
+	}
+	log.WithFields(log.Fields{
+		"snapshots": len(keep), "deletedChunks": nDeleted,
+	}).Info("chunk store pruned")
+	return nil
+}
+
+func (smc *SpotMC) chunkStore() *chunkStore {
+	return &chunkStore{url: smc.chunkStoreURL, env: smc.envelope, world: smc.world}
+}
+
+// chunkedIsNewer() tells whether the chunked snapshot was saved
+// after the tgz at SPOTMC_DATA_URL.
+func (smc *SpotMC) chunkedIsNewer(cs *chunkStore, id string) (bool, error) {
+	idx, err := cs.getIndex(id)
+	if err != nil {
+		return false, err
+	}
+	m, err := getManifest(smc.DataFileURL, smc.envelope)
+	if err != nil {
+		return false, err
+	}
+	if m == nil {
+		// The tgz predates manifests, and thus chunked snapshots
+		return true, nil
+	}
+	return idx.CreatedAt.After(m.CreatedAt), nil
+}
+
+// restoreChunked() restores a chunked snapshot into dir
+// and returns the size of the restored files.
+func (smc *SpotMC) restoreChunked(cs *chunkStore, id, dir string) (int64, error) {
+	idx, err := cs.getIndex(id)
+	if err != nil {
+		return 0, err
+	}
+	err = cs.restore(idx, dir)
+	if err != nil {
+		return 0, fmt.Errorf("restoring snapshot %s failed: %s", id, err)
+	}
+	err = idx.manifest().verifyDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	log.WithFields(log.Fields{
+		"snapshot": id, "files": len(idx.Files), "serverVersion": idx.ServerVersion,
+	}).Info("chunked snapshot restored and verified")
+
+	var n int64
+	for _, e := range idx.Files {
+		n += e.Size
+	}
+	return n, nil
+}
+
+// putChunkedDataDir() saves dir as a new chunked snapshot
+// and moves the latest pointer to it, with the same conflict check as
+// the tgz format has on the archive ETag.
+// It returns the number of bytes uploaded.
+func (smc *SpotMC) putChunkedDataDir(dir string) (int64, error) {
+	cs := smc.chunkStore()
+	latestID, remoteETag, err := cs.latest()
+	if err != nil {
+		return 0, err
+	}
+	var prev *snapshotIndex
+	if latestID != "" {
+		prev, err = cs.getIndex(latestID)
+		if err != nil {
+			// Only slower, every file is read again
+			log.WithFields(log.Fields{"snapshot": latestID, "err": err}).Warn("reading the latest snapshot index failed")
+		}
+	}
+
+	idx, n, err := cs.save(dir, smc.serverVersion(), smc.archiveFilter(), prev)
+	if err != nil {
+		return 0, err
+	}
+
+	if remoteETag != smc.chunkETag {
+		// Leave the snapshot unreferenced by latest
+		smc.notify("save-conflict", "world data was changed by someone else, saved as a conflict snapshot", log.Fields{
+			"url":          cs.snapshotURL(idx.ID),
+			"restoredETag": smc.chunkETag,
+			"remoteETag":   remoteETag,
+		})
+		return 0, errSaveConflict
+	}
+
+	etag, err := cs.setLatest(idx.ID)
+	if err != nil {
+		return 0, err
+	}
+	smc.chunkETag = etag
+	smc.chunkedCurrent = true
+
+	err = cs.prune(smc.snapshotRetention)
+	if err != nil {
+		// The snapshot is safe, only some garbage is left
+		log.WithFields(log.Fields{"err": err}).Warn("pruning chunk store failed")
+	}
+	return n, nil
+}
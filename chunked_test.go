@@ -0,0 +1,369 @@
+package spotmc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := splitChunks(data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks don't add up to the data")
+	}
+	for i, c := range chunks {
+		if len(c) > CHUNK_MAX_SIZE {
+			t.Fatalf("chunk %d is too large: %d", i, len(c))
+		}
+		if len(c) < CHUNK_MIN_SIZE && i != len(chunks)-1 {
+			t.Fatalf("chunk %d is too small: %d", i, len(c))
+		}
+	}
+
+	// Insert some bytes in the middle. Only the chunks around
+	// the edit should change.
+	edited := append([]byte{}, data[:1500000]...)
+	edited = append(edited, []byte("inserted bytes")...)
+	edited = append(edited, data[1500000:]...)
+
+	before := map[string]bool{}
+	for _, c := range chunks {
+		before[sha256Hex(c)] = true
+	}
+	changed := 0
+	for _, c := range splitChunks(edited) {
+		if !before[sha256Hex(c)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("too many chunks changed: %d of %d", changed, len(chunks))
+	}
+}
+
+func TestChunkerMatchesSplitChunks(t *testing.T) {
+	data := make([]byte, 3*1024*1024+123)
+	rand.New(rand.NewSource(2)).Read(data)
+	chunks := splitChunks(data)
+
+	// A reader returning little at a time must give the same chunks
+	c := newChunker(&slowReader{data})
+	for i := 0; ; i++ {
+		chunk, err := c.next()
+		if err != nil {
+			if i != len(chunks) {
+				t.Fatalf("got %d chunks, expected %d", i, len(chunks))
+			}
+			break
+		}
+		if i >= len(chunks) || !bytes.Equal(chunk, chunks[i]) {
+			t.Fatalf("chunk %d differs", i)
+		}
+	}
+}
+
+type slowReader struct{ data []byte }
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func newChunkTestSpotMC(t *testing.T) (*SpotMC, *fakeS3, func()) {
+	fake, restoreS3 := useFakeS3()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	os.MkdirAll(filepath.Join(dir, "world/region"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "world/region/r.0.0.mca"), data, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "server.properties"), []byte("motd=hi\n"), 0644)
+	os.Symlink("world/region", filepath.Join(dir, "region"))
+
+	smc := &SpotMC{
+		envelope:          &envelope{},
+		chunkStoreURL:     "s3://bucket/data.tgz.store/",
+		dataDirPath:       dir,
+		snapshotRetention: 2,
+	}
+	return smc, fake, func() {
+		restoreS3()
+		os.RemoveAll(dir)
+	}
+}
+
+func uploadedChunks(fake *fakeS3) int {
+	keys, _ := fake.List("s3://bucket/data.tgz.store/chunks/")
+	return len(keys)
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	smc, fake, cleanup := newChunkTestSpotMC(t)
+	defer cleanup()
+
+	_, err := smc.putChunkedDataDir(smc.dataDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := smc.chunkStore()
+	id, _, err := cs.latest()
+	if err != nil || id == "" {
+		t.Fatalf("latest wasn't set: %q, %v", id, err)
+	}
+
+	dst, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	n, err := smc.restoreChunked(cs, id, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2*1024*1024+8 {
+		t.Errorf("restored %d bytes", n)
+	}
+	for _, name := range []string{"world/region/r.0.0.mca", "server.properties"} {
+		orig, _ := ioutil.ReadFile(filepath.Join(smc.dataDirPath, name))
+		got, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, orig) {
+			t.Errorf("%s differs: %v", name, err)
+		}
+	}
+	if link, _ := os.Readlink(filepath.Join(dst, "region")); link != "world/region" {
+		t.Errorf("got symlink %q", link)
+	}
+	if uploadedChunks(fake) == 0 {
+		t.Error("no chunks uploaded")
+	}
+}
+
+func TestChunkedDedup(t *testing.T) {
+	smc, fake, cleanup := newChunkTestSpotMC(t)
+	defer cleanup()
+
+	_, err := smc.putChunkedDataDir(smc.dataDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nChunks := uploadedChunks(fake)
+
+	n, err := smc.putChunkedDataDir(smc.dataDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || uploadedChunks(fake) != nChunks {
+		t.Errorf("unchanged data uploaded %d bytes", n)
+	}
+
+	// A small change only uploads the chunks around it
+	f, err := os.OpenFile(filepath.Join(smc.dataDirPath, "world/region/r.0.0.mca"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("changed"), 1000000)
+	f.Close()
+	n, err = smc.putChunkedDataDir(smc.dataDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n > int64(2*CHUNK_MAX_SIZE) {
+		t.Errorf("a small change uploaded %d bytes", n)
+	}
+}
+
+func TestChunkedReuseUnchanged(t *testing.T) {
+	smc, _, cleanup := newChunkTestSpotMC(t)
+	defer cleanup()
+	cs := smc.chunkStore()
+	path := filepath.Join(smc.dataDirPath, "server.properties")
+
+	prev, _, err := cs.save(smc.dataDirPath, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(path)
+
+	// Same size and mtime: the entry is taken from prev without reading
+	ioutil.WriteFile(path, []byte("motd=ho\n"), 0644)
+	os.Chtimes(path, fi.ModTime(), fi.ModTime())
+	idx, _, err := cs.save(smc.dataDirPath, "", nil, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := func(idx *snapshotIndex) string {
+		for _, e := range idx.Files {
+			if e.Path == "server.properties" {
+				return e.SHA256
+			}
+		}
+		return ""
+	}
+	if sum(idx) != sum(prev) {
+		t.Error("unchanged file was read again")
+	}
+
+	// A new mtime makes it read
+	os.Chtimes(path, fi.ModTime().Add(time.Second), fi.ModTime().Add(time.Second))
+	idx, _, err = cs.save(smc.dataDirPath, "", nil, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum(idx) != sha256Hex([]byte("motd=ho\n")) {
+		t.Error("changed file wasn't read")
+	}
+}
+
+func TestChunkedVanishedFile(t *testing.T) {
+	smc, _, cleanup := newChunkTestSpotMC(t)
+	defer cleanup()
+	cs := smc.chunkStore()
+
+	// The server deletes the file after it was listed
+	keep := func(name string, dir bool) bool {
+		if name == "world/region/r.0.0.mca" {
+			os.Remove(filepath.Join(smc.dataDirPath, name))
+		}
+		return true
+	}
+	idx, _, err := cs.save(smc.dataDirPath, "", keep, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range idx.Files {
+		if e.Path == "world/region/r.0.0.mca" {
+			t.Error("vanished file is in the index")
+		}
+	}
+}
+
+func TestChunkedEncryptedNames(t *testing.T) {
+	smc, fake, cleanup := newChunkTestSpotMC(t)
+	defer cleanup()
+	key := newPassphraseKeyWrapper("secret")
+	smc.envelope = newEnvelope(key, []keyWrapper{key})
+
+	_, err := smc.putChunkedDataDir(smc.dataDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The names must not tell that a known file is stored
+	if fake.get("s3://bucket/data.tgz.store/chunks/"+sha256Hex([]byte("motd=hi\n"))) != "" {
+		t.Error("chunk is named by the hash of the plaintext")
+	}
+	if strings.Contains(fake.get("s3://bucket/data.tgz.store/key"), "motd") {
+		t.Error("key isn't sealed")
+	}
+	nChunks := uploadedChunks(fake)
+
+	// The key is kept, so a later session with the same data dedups
+	smc.envelope = newEnvelope(key, []keyWrapper{key})
+	n, err := smc.putChunkedDataDir(smc.dataDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || uploadedChunks(fake) != nChunks {
+		t.Errorf("unchanged data uploaded %d bytes", n)
+	}
+
+	cs := smc.chunkStore()
+	id, _, err := cs.latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	_, err = smc.restoreChunked(cs, id, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(filepath.Join(dst, "server.properties"))
+	if string(got) != "motd=hi\n" {
+		t.Errorf("restored %q", got)
+	}
+}
+
+func TestChunkedPrune(t *testing.T) {
+	smc, fake, cleanup := newChunkTestSpotMC(t)
+	defer cleanup()
+	cs := smc.chunkStore()
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ioutil.WriteFile(filepath.Join(smc.dataDirPath, "server.properties"), []byte(strings.Repeat("x", i+1)), 0644)
+		idx, _, err := cs.save(smc.dataDirPath, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, idx.ID)
+	}
+	// The oldest one is restored, as after a rollback
+	_, err := cs.setLatest(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cs.prune(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := cs.listSnapshots()
+	expected := []string{ids[0], ids[2], ids[3]}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("got snapshots %v, expected %v", got, expected)
+	}
+	if fake.get(cs.chunkURL(sha256Hex([]byte("xx")))) != "" {
+		t.Error("a chunk of a deleted snapshot is left")
+	}
+	for _, s := range []string{"x", "xxx", "xxxx"} {
+		if fake.get(cs.chunkURL(sha256Hex([]byte(s)))) == "" {
+			t.Errorf("chunk %q of a kept snapshot was deleted", s)
+		}
+	}
+}
+
+func TestChunkedConflict(t *testing.T) {
+	smc, fake, cleanup := newChunkTestSpotMC(t)
+	defer cleanup()
+	cs := smc.chunkStore()
+
+	_, err := smc.putChunkedDataDir(smc.dataDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance saves in the meantime
+	fake.put(cs.latestURL(), "other\n")
+
+	_, err = smc.putChunkedDataDir(smc.dataDirPath)
+	if err != errSaveConflict {
+		t.Fatalf("got %v, expected a conflict", err)
+	}
+	if id, _, _ := cs.latest(); id != "other" {
+		t.Errorf("latest was moved to %s", id)
+	}
+	ids, _ := cs.listSnapshots()
+	if len(ids) != 2 {
+		t.Errorf("the conflict snapshot wasn't kept: %v", ids)
+	}
+}
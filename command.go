@@ -0,0 +1,128 @@
+package spotmc
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var DEFAULT_SERVER_COMMAND = "{{java}} {{memory}} {{args}} -jar {{jar}} nogui"
+
+var placeholderPattern = regexp.MustCompile(`{{[^}]*}}`)
+
+// splitArgs splits a command line like a POSIX shell does, without
+// expansions: words are separated by blanks, quotes group words, and a
+// backslash escapes the next character outside single quotes.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var word []rune
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			word = append(word, r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' {
+				escaped = true
+			} else {
+				word = append(word, r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inWord {
+		args = append(args, string(word))
+	}
+	return args, nil
+}
+
+// parseArgList parses an argument list given either as a JSON array of
+// strings or as a shell-style command line.
+func parseArgList(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		var args []string
+		err := json.Unmarshal([]byte(s), &args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument list: %s", err)
+		}
+		return args, nil
+	}
+	return splitArgs(s)
+}
+
+// expandCommand fills the placeholders of a command template.
+// A placeholder standing as a whole argument expands to as many arguments
+// as it has values (possibly none); inside an argument the values are
+// joined with spaces.
+func expandCommand(template []string, values map[string][]string) ([]string, error) {
+	var args []string
+	for _, word := range template {
+		if vs, ok := values[word]; ok {
+			args = append(args, vs...)
+			continue
+		}
+		var err error
+		arg := placeholderPattern.ReplaceAllStringFunc(word, func(p string) string {
+			vs, ok := values[p]
+			if !ok {
+				err = fmt.Errorf("unknown placeholder %s", p)
+			}
+			return strings.Join(vs, " ")
+		})
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty server command")
+	}
+	return args, nil
+}
+
+// commandValues returns what the placeholders of SPOTMC_SERVER_COMMAND
+// stand for.
+func (smc *SpotMC) commandValues(memoryArgs []string) map[string][]string {
+	return map[string][]string{
+		"{{java}}":    {smc.JavaPath},
+		"{{jar}}":     {smc.serverPath},
+		"{{server}}":  {smc.serverPath},
+		"{{datadir}}": {smc.dataDirPath},
+		"{{memory}}":  memoryArgs,
+		"{{args}}":    smc.javaArgs,
+	}
+}
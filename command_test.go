@@ -0,0 +1,78 @@
+package spotmc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for s, expected := range map[string][]string{
+		"-Xmx1024M  -Xms1024M":           {"-Xmx1024M", "-Xms1024M"},
+		`-Dmotd="Hello world" -Da='b c'`: {"-Dmotd=Hello world", "-Da=b c"},
+		`a\ b "c\"d" 'e\f'`:              {"a b", `c"d`, `e\f`},
+		`"" x`:                           {"", "x"},
+		"  ":                             nil,
+		"\t-jar\nserver.jar ":            {"-jar", "server.jar"},
+	} {
+		args, err := splitArgs(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("%q: got %q, expected %q", s, args, expected)
+		}
+	}
+
+	for _, s := range []string{`"unterminated`, `'unterminated`, `trailing\`} {
+		_, err := splitArgs(s)
+		if err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestParseArgList(t *testing.T) {
+	args, err := parseArgList(`["-Xmx1G", "-Dname=a b"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []string{"-Xmx1G", "-Dname=a b"}) {
+		t.Errorf("got %q", args)
+	}
+}
+
+func TestExpandCommand(t *testing.T) {
+	values := map[string][]string{
+		"{{java}}":    {"/usr/bin/java"},
+		"{{jar}}":     {"/tmp/server.jar"},
+		"{{datadir}}": {"/tmp/data"},
+		"{{memory}}":  {"-Xms1G", "-Xmx1G"},
+		"{{args}}":    nil,
+	}
+
+	template, _ := splitArgs(DEFAULT_SERVER_COMMAND)
+	args, err := expandCommand(template, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/usr/bin/java", "-Xms1G", "-Xmx1G", "-jar", "/tmp/server.jar", "nogui"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("got %q, expected %q", args, expected)
+	}
+
+	template, _ = splitArgs(`{{java}} @{{datadir}}/unix_args.txt "-Dflags={{memory}}"`)
+	args, err = expandCommand(template, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"/usr/bin/java", "@/tmp/data/unix_args.txt", "-Dflags=-Xms1G -Xmx1G"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("got %q, expected %q", args, expected)
+	}
+
+	_, err = expandCommand([]string{"{{java}}", "{{unknown}}"}, values)
+	if err == nil {
+		t.Error("expected an error for an unknown placeholder")
+	}
+}
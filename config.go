@@ -0,0 +1,104 @@
+package spotmc
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+// parseConfigFile reads KEY=VALUE lines as in a systemd EnvironmentFile
+// or a shell script: blank lines and "#" comments are skipped, an
+// "export " prefix is allowed and quotes around the value are removed.
+func parseConfigFile(r io.Reader) (map[string]string, error) {
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNo)
+		}
+		k := strings.TrimSpace(line[:i])
+		v := strings.TrimSpace(line[i+1:])
+		// Only a value which is a single quoted word. Values like
+		// "-Da=b c" -Xmx1G "-Dd=e f" are left for splitArgs.
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] &&
+			!strings.ContainsRune(v[1:len(v)-1], rune(v[0])) {
+			v = v[1 : len(v)-1]
+		}
+		vars[k] = v
+	}
+	return vars, scanner.Err()
+}
+
+// loadConfigFile puts the variables of SPOTMC_CONFIG_FILE into the
+// environment, overriding what's there, so that a reload picks up edits.
+func loadConfigFile() error {
+	path := os.Getenv("SPOTMC_CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	vars, err := parseConfigFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	return nil
+}
+
+// reloadConfig() re-reads the configuration and applies what can be
+// changed while the game server is running. Where the data is stored,
+// how it's encrypted and the game server itself need a restart.
+func (smc *SpotMC) reloadConfig() error {
+	n, err := NewSpotMC()
+	if err != nil {
+		return err
+	}
+
+	// Don't change the settings under a running save
+	smc.saveMu.Lock()
+	defer smc.saveMu.Unlock()
+	smc.mu.Lock()
+	defer smc.mu.Unlock()
+
+	smc.ddnsURL = n.ddnsURL
+	smc.notifyURL = n.notifyURL
+	smc.killInstanceMode = n.killInstanceMode
+	smc.shutdownCommand = n.shutdownCommand
+	smc.maxIdleTime = n.maxIdleTime
+	smc.maxUptime = n.maxUptime
+	smc.idleWatchPath = n.idleWatchPath
+	smc.stopTimeout = n.stopTimeout
+	smc.saveTimeout = n.saveTimeout
+	smc.maxRestarts = n.maxRestarts
+	smc.restartWindow = n.restartWindow
+	smc.restartBackoff = n.restartBackoff
+	smc.snapshotRetention = n.snapshotRetention
+	smc.compression = n.compression
+	smc.compressionLevel = n.compressionLevel
+	smc.deadlineMargin = n.deadlineMargin
+	smc.deadlineFallback = n.deadlineFallback
+
+	log.WithFields(log.Fields{
+		"maxIdleTime": smc.maxIdleTime, "maxUptime": smc.maxUptime,
+		"killInstanceMode": smc.killInstanceMode,
+	}).Info("configuration reloaded")
+	return nil
+}
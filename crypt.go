@@ -0,0 +1,476 @@
+package spotmc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kms"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Encrypted objects start with the magic, followed by the header:
+//
+//	wrapper ID length (1) | wrapper ID | wrapped key length (2) | wrapped key | nonce prefix (8)
+//
+// and then AES-256-GCM sealed segments:
+//
+//	final flag (1) | ciphertext length (4) | ciphertext
+//
+// Each segment's nonce is the prefix and the segment counter, and the
+// final flag is authenticated so that truncated data is detected.
+var encryptionMagic = []byte("SPMCENC\x01")
+
+var ENCRYPTION_SEGMENT_SIZE = 64 * 1024
+
+// scrypt parameters to derive the key encryption key from a passphrase
+var SCRYPT_N = 1 << 15
+var SCRYPT_R = 8
+var SCRYPT_P = 1
+
+var errNoKeyWrapper = errors.New("data is encrypted but no usable key is configured")
+var errPlaintext = errors.New("data isn't encrypted, set SPOTMC_ENCRYPTION_ALLOW_PLAINTEXT=true to restore it anyway")
+
+// OLD_PASSPHRASE_PREFIX is followed by any suffix, one variable per
+// passphrase, so passphrases can contain any character.
+var OLD_PASSPHRASE_PREFIX = "SPOTMC_ENCRYPTION_OLD_PASSPHRASE_"
+
+// keyWrapper protects the random data key of an encrypted object.
+type keyWrapper interface {
+	// ID is stored in the header to pick the wrapper on decryption
+	ID() string
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// passphraseKeyWrapper wraps data keys with a key derived from a passphrase.
+// The wrapped key is salt (16) | nonce (12) | sealed data key.
+type passphraseKeyWrapper struct {
+	passphrase string
+	mu         sync.Mutex
+	keks       map[string][]byte // salt -> derived key
+}
+
+func newPassphraseKeyWrapper(passphrase string) *passphraseKeyWrapper {
+	return &passphraseKeyWrapper{passphrase: passphrase, keks: map[string][]byte{}}
+}
+
+// oldPassphrases returns the values of the OLD_PASSPHRASE_PREFIX
+// variables of environ, ordered by name.
+func oldPassphrases(environ []string) []string {
+	var names []string
+	values := map[string]string{}
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], OLD_PASSPHRASE_PREFIX) || kv[i+1:] == "" {
+			continue
+		}
+		names = append(names, kv[:i])
+		values[kv[:i]] = kv[i+1:]
+	}
+	sort.Strings(names)
+	var passphrases []string
+	for _, name := range names {
+		passphrases = append(passphrases, values[name])
+	}
+	return passphrases
+}
+
+func (p *passphraseKeyWrapper) ID() string { return "passphrase" }
+
+func (p *passphraseKeyWrapper) kek(salt []byte) (cipher.AEAD, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keks[string(salt)]
+	if !ok {
+		var err error
+		key, err = scrypt.Key([]byte(p.passphrase), salt, SCRYPT_N, SCRYPT_R, SCRYPT_P, 32)
+		if err != nil {
+			return nil, err
+		}
+		p.keks[string(salt)] = key
+	}
+	return newGCM(key)
+}
+
+func (p *passphraseKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := p.kek(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := append(salt, nonce...)
+	return aead.Seal(wrapped, nonce, dataKey, nil), nil
+}
+
+func (p *passphraseKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 16+12 {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	aead, err := p.kek(wrapped[:16])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, wrapped[16:28], wrapped[28:], nil)
+}
+
+// kmsKeyWrapper wraps data keys with a KMS key.
+// KMS ciphertexts tell which key they were made with, so data
+// encrypted before a key rotation can still be decrypted.
+type kmsKeyWrapper struct {
+	keyID string
+}
+
+func kmsClient() *kms.KMS {
+	region := os.Getenv("SPOTMC_AWS_REGION")
+	if region == "" {
+		region = DEFAULT_REGION
+	}
+	return kms.New(&aws.Config{Region: region})
+}
+
+func (k *kmsKeyWrapper) ID() string { return "kms" }
+
+func (k *kmsKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	res, err := kmsClient().Encrypt(&kms.EncryptInput{
+		KeyID:     aws.String(k.keyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.CiphertextBlob, nil
+}
+
+func (k *kmsKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	res, err := kmsClient().Decrypt(&kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return res.Plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// envelope encrypts with the current wrapper and decrypts with any of
+// the known ones. A single data key is used for everything this process
+// encrypts, so the (slow) wrapping happens only once.
+type envelope struct {
+	wrapper  keyWrapper
+	wrappers []keyWrapper
+	// Whether unencrypted data is accepted when encryption is enabled
+	allowPlaintext bool
+
+	mu        sync.Mutex
+	dataKey   []byte
+	wrapped   []byte
+	unwrapped map[string][]byte
+}
+
+// newEnvelope returns an envelope which doesn't encrypt if wrapper is nil,
+// but can still decrypt data for which one of wrappers has the key.
+func newEnvelope(wrapper keyWrapper, wrappers []keyWrapper) *envelope {
+	return &envelope{wrapper: wrapper, wrappers: wrappers, unwrapped: map[string][]byte{}}
+}
+
+func (e *envelope) enabled() bool {
+	return e.wrapper != nil
+}
+
+func (e *envelope) sessionKey() (dataKey, wrapped []byte, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.dataKey == nil {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, err := e.wrapper.Wrap(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.dataKey, e.wrapped = key, w
+	}
+	return e.dataKey, e.wrapped, nil
+}
+
+func (e *envelope) unwrap(id string, wrapped []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if key, ok := e.unwrapped[id+string(wrapped)]; ok {
+		return key, nil
+	}
+	for _, w := range e.wrappers {
+		if w.ID() != id {
+			continue
+		}
+		key, err := w.Unwrap(wrapped)
+		if err == nil {
+			e.unwrapped[id+string(wrapped)] = key
+			return key, nil
+		}
+	}
+	return nil, errNoKeyWrapper
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encryptWriter returns a writer which encrypts into w.
+// Close must be called to write the final segment.
+// If encryption is disabled, w is passed through.
+func (e *envelope) encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	if !e.enabled() {
+		return nopWriteCloser{w}, nil
+	}
+	dataKey, wrapped, err := e.sessionKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr bytes.Buffer
+	hdr.Write(encryptionMagic)
+	hdr.WriteByte(byte(len(e.wrapper.ID())))
+	hdr.WriteString(e.wrapper.ID())
+	binary.Write(&hdr, binary.BigEndian, uint16(len(wrapped)))
+	hdr.Write(wrapped)
+	hdr.Write(prefix)
+	_, err = w.Write(hdr.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentWriter{w: w, aead: aead, prefix: prefix}, nil
+}
+
+type segmentWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func (sw *segmentWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// Only flush a full segment when more data follows,
+		// so the last one can be marked as final on Close
+		if len(sw.buf) == ENCRYPTION_SEGMENT_SIZE {
+			err := sw.flush(false)
+			if err != nil {
+				return 0, err
+			}
+		}
+		m := ENCRYPTION_SEGMENT_SIZE - len(sw.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		sw.buf = append(sw.buf, p[:m]...)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (sw *segmentWriter) flush(final bool) error {
+	flag := []byte{0}
+	if final {
+		flag[0] = 1
+	}
+	ct := sw.aead.Seal(nil, segmentNonce(sw.prefix, sw.counter), sw.buf, flag)
+	sw.counter++
+	sw.buf = sw.buf[:0]
+
+	var hdr [5]byte
+	hdr[0] = flag[0]
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(ct)))
+	_, err := sw.w.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+	_, err = sw.w.Write(ct)
+	return err
+}
+
+func (sw *segmentWriter) Close() error {
+	return sw.flush(true)
+}
+
+func segmentNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+// decryptReader returns a reader of the plaintext of r.
+// Data which isn't encrypted is passed through if encryption is disabled
+// or allowPlaintext is set, so that snapshots saved before encryption
+// was enabled can still be restored. Otherwise it's refused, as anyone
+// who can write to the bucket could make the server load it.
+func (e *envelope) decryptReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(head, encryptionMagic) {
+		if e.enabled() && !e.allowPlaintext {
+			return nil, errPlaintext
+		}
+		return br, nil
+	}
+	br.Discard(len(encryptionMagic))
+
+	idLen, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, idLen)
+	_, err = io.ReadFull(br, id)
+	if err != nil {
+		return nil, err
+	}
+	var wrappedLen uint16
+	err = binary.Read(br, binary.BigEndian, &wrappedLen)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]byte, wrappedLen)
+	_, err = io.ReadFull(br, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	_, err = io.ReadFull(br, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := e.unwrap(string(id), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{r: br, aead: aead, prefix: prefix}, nil
+}
+
+type segmentReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	final   bool
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		if sr.final {
+			return 0, io.EOF
+		}
+		var hdr [5]byte
+		_, err := io.ReadFull(sr.r, hdr[:])
+		if err != nil {
+			if err == io.EOF {
+				return 0, fmt.Errorf("encrypted data is truncated")
+			}
+			return 0, err
+		}
+		ctLen := binary.BigEndian.Uint32(hdr[1:])
+		if ctLen > uint32(ENCRYPTION_SEGMENT_SIZE+sr.aead.Overhead()) {
+			return 0, fmt.Errorf("encrypted segment %d is too large", sr.counter)
+		}
+		ct := make([]byte, ctLen)
+		_, err = io.ReadFull(sr.r, ct)
+		if err != nil {
+			return 0, err
+		}
+		pt, err := sr.aead.Open(nil, segmentNonce(sr.prefix, sr.counter), ct, hdr[:1])
+		if err != nil {
+			return 0, fmt.Errorf("decrypting segment %d failed: %s", sr.counter, err)
+		}
+		sr.counter++
+		sr.final = hdr[0] == 1
+		sr.buf = pt
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// seal encrypts a small object in one go.
+func (e *envelope) seal(data []byte) ([]byte, error) {
+	if !e.enabled() {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w, err := e.encryptWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// open undoes seal, passing unencrypted data through like decryptReader.
+func (e *envelope) open(data []byte) ([]byte, error) {
+	r, err := e.decryptReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, r)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package spotmc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	data := make([]byte, 3*ENCRYPTION_SEGMENT_SIZE+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	oldKey := newPassphraseKeyWrapper("old secret")
+	oldEnv := newEnvelope(oldKey, []keyWrapper{oldKey})
+	sealed, err := oldEnv.seal(data)
+	if err != nil {
+		t.Fatal("seal failed", err)
+	}
+	if bytes.Contains(sealed, data[:64]) {
+		t.Fatal("sealed data contains the plaintext")
+	}
+
+	// After rotating the passphrase, old data must still open
+	newKey := newPassphraseKeyWrapper("new secret")
+	env := newEnvelope(newKey, []keyWrapper{newKey, newPassphraseKeyWrapper("old secret")})
+	opened, err := env.open(sealed)
+	if err != nil {
+		t.Fatal("open failed", err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Fatal("data doesn't match")
+	}
+
+	// ...but not without the old passphrase
+	_, err = newEnvelope(newKey, []keyWrapper{newKey}).open(sealed)
+	if err == nil {
+		t.Fatal("open succeeded with a wrong passphrase")
+	}
+
+	// Truncation and tampering must be detected
+	_, err = env.open(sealed[:len(sealed)-200])
+	if err == nil {
+		t.Fatal("open didn't detect truncated data")
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)/2] ^= 1
+	_, err = env.open(tampered)
+	if err == nil {
+		t.Fatal("open didn't detect tampered data")
+	}
+
+	// Unencrypted data is refused unless allowed
+	plain := []byte("unencrypted old snapshot")
+	_, err = env.open(plain)
+	if err != errPlaintext {
+		t.Fatal("open accepted unencrypted data", err)
+	}
+	env.allowPlaintext = true
+	opened, err = env.open(plain)
+	if err != nil {
+		t.Fatal("open failed", err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Fatal("unencrypted data doesn't match")
+	}
+	env.allowPlaintext = false
+	opened, err = (&envelope{}).open(plain)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatal("unencrypted data doesn't pass through without encryption", err)
+	}
+
+	// Streaming
+	var buf bytes.Buffer
+	w, err := env.encryptWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += 1000 {
+		j := i + 1000
+		if j > len(data) {
+			j = len(data)
+		}
+		w.Write(data[i:j])
+	}
+	w.Close()
+	r, err := env.decryptReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("reading decrypted stream failed", err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Fatal("streamed data doesn't match")
+	}
+}
+
+func TestOldPassphrases(t *testing.T) {
+	got := oldPassphrases([]string{
+		"SPOTMC_ENCRYPTION_PASSPHRASE=current",
+		"SPOTMC_ENCRYPTION_OLD_PASSPHRASE_2=with,comma",
+		"SPOTMC_ENCRYPTION_OLD_PASSPHRASE_1=with=equals",
+		"SPOTMC_ENCRYPTION_OLD_PASSPHRASE_3=",
+		"OTHER=x",
+	})
+	if len(got) != 2 || got[0] != "with=equals" || got[1] != "with,comma" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,174 @@
+package spotmc
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Save strategies
+const (
+	saveFull        = "full"        // the configured format and compression
+	saveIncremental = "incremental" // only changed chunks into the chunk store
+	saveFast        = "fast"        // uncompressed tar, no CPU spent on compression
+)
+
+var DEFAULT_DEADLINE_MARGIN = 20
+var DEFAULT_DEADLINE_FALLBACK = saveIncremental
+
+// Ignore measurements too small to tell the throughput
+var THROUGHPUT_MIN_BYTES = int64(1024 * 1024)
+
+// dirStats sums up the size of the regular files under dir,
+// and the size of those modified after since.
+func dirStats(dir string, since time.Time) (total, changed int64, err error) {
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		total += fi.Size()
+		if fi.ModTime().After(since) {
+			changed += fi.Size()
+		}
+		return nil
+	})
+	return total, changed, err
+}
+
+// recordRestore() takes the restore as a first guess of the throughput,
+// until a save measures the upload, and learns how well the data
+// compresses.
+func (smc *SpotMC) recordRestore(dir string, n int64, d time.Duration) {
+	smc.restoredAt = time.Now()
+	if n >= THROUGHPUT_MIN_BYTES && d > 0 {
+		smc.throughput = float64(n) / d.Seconds()
+	}
+
+	total, _, err := dirStats(dir, smc.restoredAt)
+	if err == nil && total > 0 && n > 0 {
+		smc.compressionRatio = float64(n) / float64(total)
+	}
+}
+
+// recordThroughput() keeps a moving average of the upload speed of
+// saves, in bytes per second. The first save replaces the guess taken
+// from the restore, which was a download.
+func (smc *SpotMC) recordThroughput(n int64, d time.Duration) {
+	if n < THROUGHPUT_MIN_BYTES || d <= 0 {
+		return
+	}
+	bps := float64(n) / d.Seconds()
+	if !smc.saveMeasured {
+		smc.throughput = bps
+		smc.saveMeasured = true
+	} else {
+		smc.throughput = 0.5*smc.throughput + 0.5*bps
+	}
+	log.WithFields(log.Fields{
+		"bytes": n, "seconds": d.Seconds(), "bytesPerSec": int64(smc.throughput),
+	}).Debug("throughput recorded")
+}
+
+// saveStrategy() picks how to save dir, the data dir or a copy of it.
+// Without a deadline it's always a full save. With one (a spot
+// termination notice), the size of each strategy is estimated from the
+// data dir and the measured throughput, and the full save is used only
+// if it fits in the time left. Otherwise the configured fallback is used.
+// An incremental save only uploads the files changed since the restore
+// if the chunk store had what was restored. If it doesn't, it would
+// upload the whole world uncompressed, so the fast save is used instead.
+func (smc *SpotMC) saveStrategy(dir string) (strategy string, estimate time.Duration) {
+	deadline := smc.deadline()
+	if deadline.IsZero() || smc.throughput == 0 {
+		return saveFull, 0
+	}
+
+	total, changed, err := dirStats(dir, smc.restoredAt)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("estimating save size failed")
+		return saveFull, 0
+	}
+
+	ratio := smc.compressionRatio
+	if ratio == 0 || ratio > 1 {
+		ratio = 1
+	}
+	if !smc.chunkedCurrent {
+		changed = total
+	}
+	estimates := map[string]time.Duration{
+		saveFull:        smc.transferTime(int64(float64(total) * ratio)),
+		saveIncremental: smc.transferTime(changed),
+		saveFast:        smc.transferTime(total),
+	}
+	if smc.backupFormat == "chunked" {
+		// Already incremental
+		estimates[saveFull] = estimates[saveIncremental]
+	}
+
+	left := deadline.Sub(time.Now()) - time.Duration(smc.deadlineMargin)*time.Second
+	strategy = saveFull
+	if estimates[saveFull] > left {
+		strategy = smc.deadlineFallback
+		if strategy == saveIncremental && !smc.chunkedCurrent {
+			strategy = saveFast
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"strategy": strategy, "timeLeft": left.Seconds(),
+		"full": estimates[saveFull].Seconds(), "incremental": estimates[saveIncremental].Seconds(),
+		"fast": estimates[saveFast].Seconds(),
+	}).Info("save strategy chosen")
+	return strategy, estimates[strategy]
+}
+
+// deadline() is the spot termination time, zero until a notice comes.
+// It's set by the termination watcher, in another goroutine.
+func (smc *SpotMC) deadline() time.Time {
+	smc.mu.Lock()
+	defer smc.mu.Unlock()
+	return smc.saveDeadline
+}
+
+func (smc *SpotMC) setDeadline(t time.Time) {
+	smc.mu.Lock()
+	defer smc.mu.Unlock()
+	smc.saveDeadline = t
+}
+
+func (smc *SpotMC) transferTime(n int64) time.Duration {
+	return time.Duration(float64(n) / smc.throughput * float64(time.Second))
+}
+
+// reportSave() logs, and notifies when racing a deadline,
+// which strategy was used and whether it made it in time.
+func (smc *SpotMC) reportSave(strategy string, estimate, elapsed time.Duration, err error) {
+	fields := log.Fields{
+		"strategy": strategy, "estimate": estimate.Seconds(), "elapsed": elapsed.Seconds(),
+	}
+	deadline := smc.deadline()
+	if deadline.IsZero() {
+		log.WithFields(fields).Info("save finished")
+		return
+	}
+
+	inTime := time.Now().Before(deadline)
+	fields["deadline"] = deadline
+	fields["inTime"] = inTime
+	if err != nil {
+		fields["err"] = err.Error()
+	}
+	msg := fmt.Sprintf("%s save before spot termination finished", strategy)
+	if err != nil {
+		msg = fmt.Sprintf("%s save before spot termination failed", strategy)
+	} else if !inTime {
+		msg = fmt.Sprintf("%s save before spot termination missed the deadline", strategy)
+	}
+	smc.notify("deadline-save", msg, fields)
+}
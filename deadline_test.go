@@ -0,0 +1,169 @@
+package spotmc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var MiB = int64(1024 * 1024)
+
+func TestDirStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-time.Hour)
+	os.MkdirAll(filepath.Join(dir, "world"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "world/old"), make([]byte, 100), 0644)
+	os.Chtimes(filepath.Join(dir, "world/old"), old, old)
+	ioutil.WriteFile(filepath.Join(dir, "new"), make([]byte, 10), 0644)
+	os.Symlink("world", filepath.Join(dir, "link"))
+
+	total, changed, err := dirStats(dir, old.Add(time.Minute))
+	if err != nil || total != 110 || changed != 10 {
+		t.Errorf("got %d, %d, %v", total, changed, err)
+	}
+}
+
+func TestRecordThroughput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, _ := os.Create(filepath.Join(dir, "world"))
+	f.Truncate(40 * MiB)
+	f.Close()
+
+	smc := &SpotMC{}
+	// Downloaded at 100MiB/s
+	smc.recordRestore(dir, 20*MiB, 200*time.Millisecond)
+	if smc.throughput != float64(100*MiB) || smc.compressionRatio != 0.5 {
+		t.Fatalf("got %f, ratio %f", smc.throughput, smc.compressionRatio)
+	}
+	// The first save replaces the guess
+	smc.recordThroughput(10*MiB, time.Second)
+	if smc.throughput != float64(10*MiB) {
+		t.Errorf("got %f after the first save", smc.throughput)
+	}
+	// Then it's averaged
+	smc.recordThroughput(20*MiB, time.Second)
+	if smc.throughput != float64(15*MiB) {
+		t.Errorf("got %f after the second save", smc.throughput)
+	}
+	// Too small to tell
+	smc.recordThroughput(1000, time.Second)
+	if smc.throughput != float64(15*MiB) {
+		t.Errorf("got %f after a small save", smc.throughput)
+	}
+}
+
+func TestSaveStrategy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 100MiB in all, 1MiB changed since the restore
+	restoredAt := time.Now().Add(-time.Hour)
+	old := restoredAt.Add(-time.Hour)
+	f, _ := os.Create(filepath.Join(dir, "region"))
+	f.Truncate(99 * MiB)
+	f.Close()
+	os.Chtimes(filepath.Join(dir, "region"), old, old)
+	f, _ = os.Create(filepath.Join(dir, "level.dat"))
+	f.Truncate(1 * MiB)
+	f.Close()
+
+	for _, c := range []struct {
+		name           string
+		deadline       time.Duration
+		throughput     float64
+		format         string
+		fallback       string
+		chunkedCurrent bool
+		expected       string
+		estimate       time.Duration
+	}{
+		{"no deadline", 0, float64(10 * MiB), "tgz", saveIncremental, true, saveFull, 0},
+		{"no throughput", 2 * time.Second, 0, "tgz", saveIncremental, true, saveFull, 0},
+		{"full fits", time.Minute, float64(10 * MiB), "tgz", saveIncremental, true, saveFull, 5 * time.Second},
+		{"incremental", 2 * time.Second, float64(10 * MiB), "tgz", saveIncremental, true, saveIncremental, 100 * time.Millisecond},
+		// The chunk store doesn't have the restored world
+		{"stale chunk store", 2 * time.Second, float64(10 * MiB), "tgz", saveIncremental, false, saveFast, 10 * time.Second},
+		{"fast", 2 * time.Second, float64(10 * MiB), "tgz", saveFast, true, saveFast, 10 * time.Second},
+		{"chunked format", 2 * time.Second, float64(10 * MiB), "chunked", saveIncremental, true, saveFull, 100 * time.Millisecond},
+	} {
+		smc := &SpotMC{
+			backupFormat:     c.format,
+			deadlineFallback: c.fallback,
+			throughput:       c.throughput,
+			compressionRatio: 0.5,
+			restoredAt:       restoredAt,
+			chunkedCurrent:   c.chunkedCurrent,
+		}
+		if c.deadline != 0 {
+			smc.setDeadline(time.Now().Add(c.deadline))
+		}
+		strategy, estimate := smc.saveStrategy(dir)
+		if strategy != c.expected {
+			t.Errorf("%s: got %s, expected %s", c.name, strategy, c.expected)
+		}
+		if d := estimate - c.estimate; d > time.Millisecond || d < -time.Millisecond {
+			t.Errorf("%s: estimated %s, expected %s", c.name, estimate, c.estimate)
+		}
+	}
+}
+
+func TestReportSave(t *testing.T) {
+	var got []notification
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		json.NewDecoder(r.Body).Decode(&n)
+		got = append(got, n)
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		deadline time.Duration
+		err      error
+		expected string
+	}{
+		{0, nil, ""},
+		{time.Minute, nil, "incremental save before spot termination finished"},
+		{-time.Second, nil, "incremental save before spot termination missed the deadline"},
+		{time.Minute, fmt.Errorf("upload failed"), "incremental save before spot termination failed"},
+	} {
+		got = nil
+		smc := &SpotMC{notifyURL: ts.URL}
+		if c.deadline != 0 {
+			smc.setDeadline(time.Now().Add(c.deadline))
+		}
+		smc.reportSave(saveIncremental, time.Second, 2*time.Second, c.err)
+		if c.expected == "" {
+			if len(got) != 0 {
+				t.Errorf("notified without a deadline: %v", got)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0].Event != "deadline-save" || got[0].Message != c.expected {
+			t.Errorf("got %v, expected %q", got, c.expected)
+			continue
+		}
+		if inTime := got[0].Fields["inTime"].(bool); inTime != (c.deadline > 0) {
+			t.Errorf("%q: got inTime %v", c.expected, inTime)
+		}
+		if c.err != nil && !strings.Contains(fmt.Sprint(got[0].Fields["err"]), "upload failed") {
+			t.Errorf("got fields %v", got[0].Fields)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package spotmc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeS3 is an in-memory s3Backend for tests.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+	// Called before each put, to play another instance
+	beforePut func(url string)
+}
+
+// useFakeS3 swaps s3Objects for a fakeS3 until restore is called.
+func useFakeS3() (fake *fakeS3, restore func()) {
+	orig := s3Objects
+	fake = &fakeS3{objects: map[string][]byte{}}
+	s3Objects = fake
+	return fake, func() { s3Objects = orig }
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) GetStream(url string) (io.ReadCloser, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[url]
+	if !ok {
+		return nil, "", &aws.APIError{StatusCode: 404, Code: "NoSuchKey"}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), fakeETag(data), nil
+}
+
+func (f *fakeS3) HeadETag(url string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[url]
+	if !ok {
+		return "", nil
+	}
+	return fakeETag(data), nil
+}
+
+func (f *fakeS3) PutBytes(url string, data []byte) error {
+	if f.beforePut != nil {
+		f.beforePut(url)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[url] = append([]byte{}, data...)
+	f.puts++
+	return nil
+}
+
+func (f *fakeS3) PutStream(url string, r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	err = f.PutBytes(url, data)
+	if err != nil {
+		return "", err
+	}
+	return fakeETag(data), nil
+}
+
+func (f *fakeS3) Delete(url string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, url)
+	return nil
+}
+
+func (f *fakeS3) List(prefix string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for url := range f.objects {
+		if strings.HasPrefix(url, prefix) {
+			keys = append(keys, strings.TrimPrefix(url, prefix))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *fakeS3) get(url string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(f.objects[url])
+}
+
+func (f *fakeS3) put(url, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[url] = []byte(data)
+}
@@ -0,0 +1,290 @@
+package spotmc
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var DEFAULT_MOJANG_MANIFEST_URL = "https://piston-meta.mojang.com/mc/game/version_manifest_v2.json"
+var DEFAULT_PAPER_API_URL = "https://api.papermc.io/v2/projects/paper"
+var CACHE_SUFFIX = ".cache/"
+var JAR_API_TIMEOUT = 30 * time.Second
+
+// jarRelease is a server jar found in a vendor's manifest.
+type jarRelease struct {
+	Name   string // file name in the cache, like "mojang-1.20.4.jar"
+	URL    string
+	SHA1   string
+	SHA256 string
+}
+
+// isJarSpec tells whether SPOTMC_SERVER_JAR_URL is a version to resolve,
+// like "mojang:1.20.4", rather than a URL.
+func isJarSpec(s string) bool {
+	return strings.HasPrefix(s, "mojang:") || strings.HasPrefix(s, "paper:")
+}
+
+// pinnedJarName returns the cache file name of a spec which always
+// resolves to the same jar, or "" if it depends on what's latest.
+func pinnedJarName(spec string) string {
+	parts := strings.Split(spec, ":")
+	switch {
+	case parts[0] == "mojang" && len(parts) == 2 && !strings.HasPrefix(parts[1], "latest"):
+		return fmt.Sprintf("mojang-%s.jar", parts[1])
+	case parts[0] == "paper" && len(parts) == 3 && isNumber(parts[2]):
+		return fmt.Sprintf("paper-%s-%s.jar", parts[1], parts[2])
+	}
+	return ""
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// resolveJarSpec finds the jar of a spec:
+//
+//	mojang:<version>, mojang:latest-release, mojang:latest-snapshot
+//	paper:<version>:<build>, paper:<version>:latest, paper:latest
+func resolveJarSpec(spec, mojangManifestURL, paperAPIURL string) (*jarRelease, error) {
+	parts := strings.Split(spec, ":")
+	switch {
+	case parts[0] == "mojang" && len(parts) == 2:
+		return resolveMojang(mojangManifestURL, parts[1])
+	case parts[0] == "paper" && len(parts) == 2 && parts[1] == "latest":
+		return resolvePaper(paperAPIURL, "latest", "latest")
+	case parts[0] == "paper" && len(parts) == 3:
+		return resolvePaper(paperAPIURL, parts[1], parts[2])
+	}
+	return nil, fmt.Errorf("invalid server jar spec: %s", spec)
+}
+
+func resolveMojang(manifestURL, version string) (*jarRelease, error) {
+	var manifest struct {
+		Latest struct {
+			Release  string `json:"release"`
+			Snapshot string `json:"snapshot"`
+		} `json:"latest"`
+		Versions []struct {
+			ID  string `json:"id"`
+			URL string `json:"url"`
+		} `json:"versions"`
+	}
+	err := getJSON(manifestURL, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case "latest-release":
+		version = manifest.Latest.Release
+	case "latest-snapshot":
+		version = manifest.Latest.Snapshot
+	}
+
+	for _, v := range manifest.Versions {
+		if v.ID != version {
+			continue
+		}
+		var meta struct {
+			Downloads struct {
+				Server *struct {
+					SHA1 string `json:"sha1"`
+					URL  string `json:"url"`
+				} `json:"server"`
+			} `json:"downloads"`
+		}
+		err = getJSON(v.URL, &meta)
+		if err != nil {
+			return nil, err
+		}
+		if meta.Downloads.Server == nil {
+			return nil, fmt.Errorf("minecraft %s has no server jar", version)
+		}
+		return &jarRelease{
+			Name: fmt.Sprintf("mojang-%s.jar", version),
+			URL:  meta.Downloads.Server.URL,
+			SHA1: meta.Downloads.Server.SHA1,
+		}, nil
+	}
+	return nil, fmt.Errorf("minecraft version not found: %s", version)
+}
+
+func resolvePaper(apiURL, version, build string) (*jarRelease, error) {
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	if version == "latest" {
+		var project struct {
+			Versions []string `json:"versions"`
+		}
+		err := getJSON(apiURL, &project)
+		if err != nil {
+			return nil, err
+		}
+		if len(project.Versions) == 0 {
+			return nil, fmt.Errorf("no paper versions")
+		}
+		version = project.Versions[len(project.Versions)-1]
+	}
+
+	var builds struct {
+		Builds []struct {
+			Build     int    `json:"build"`
+			Channel   string `json:"channel"`
+			Downloads struct {
+				Application struct {
+					Name   string `json:"name"`
+					SHA256 string `json:"sha256"`
+				} `json:"application"`
+			} `json:"downloads"`
+		} `json:"builds"`
+	}
+	err := getJSON(fmt.Sprintf("%s/versions/%s/builds", apiURL, version), &builds)
+	if err != nil {
+		return nil, err
+	}
+
+	// Builds are in ascending order. "latest" is the newest stable build.
+	for i := len(builds.Builds) - 1; i >= 0; i-- {
+		b := builds.Builds[i]
+		if build == "latest" && b.Channel != "" && b.Channel != "default" {
+			continue
+		}
+		if build != "latest" && strconv.Itoa(b.Build) != build {
+			continue
+		}
+		app := b.Downloads.Application
+		return &jarRelease{
+			Name:   fmt.Sprintf("paper-%s-%d.jar", version, b.Build),
+			URL:    fmt.Sprintf("%s/versions/%s/builds/%d/downloads/%s", apiURL, version, b.Build, app.Name),
+			SHA256: app.SHA256,
+		}, nil
+	}
+	return nil, fmt.Errorf("paper %s build %s not found", version, build)
+}
+
+func getJSON(url string, v interface{}) error {
+	cli := http.Client{Timeout: JAR_API_TIMEOUT}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// verify checks the file against the checksum published for the release.
+func (r *jarRelease) verify(path string) error {
+	var h hash.Hash
+	var expected string
+	switch {
+	case r.SHA256 != "":
+		h, expected = sha256.New(), r.SHA256
+	case r.SHA1 != "":
+		h, expected = sha1.New(), r.SHA1
+	default:
+		return fmt.Errorf("no checksum published for %s", r.Name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sum, expected) {
+		return fmt.Errorf("%s checksum mismatch: expected %s, got %s", r.Name, expected, sum)
+	}
+	return nil
+}
+
+// download fetches the release from the vendor into path and verifies it.
+func (r *jarRelease) download(path string) error {
+	body, err := openURL(r.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return r.verify(path)
+}
+
+// resolveJar() gets the jar of the spec in SPOTMC_SERVER_JAR_URL into path.
+// Jars are cached under SPOTMC_CACHE_URL, so later boots don't depend on
+// the vendor's download servers. If the vendor's manifest can't be read,
+// a pinned version is still taken from the cache.
+func (smc *SpotMC) resolveJar(path string) error {
+	spec := smc.JarFileURL
+	rel, err := resolveJarSpec(spec, smc.mojangManifestURL, smc.paperAPIURL)
+	if err != nil {
+		name := pinnedJarName(spec)
+		if name == "" {
+			return err
+		}
+		log.WithFields(log.Fields{"spec": spec, "err": err}).Warn("resolving the server jar failed, trying the cache")
+		err = S3Get(smc.jarCacheURL(name), path)
+		if err != nil {
+			return err
+		}
+		smc.serverName = name
+		return nil
+	}
+	smc.serverName = rel.Name
+	logFields := log.Fields{"spec": spec, "name": rel.Name, "cacheURL": smc.jarCacheURL(rel.Name)}
+
+	etag, err := S3HeadETag(smc.jarCacheURL(rel.Name))
+	if err == nil && etag != "" {
+		err = S3Get(smc.jarCacheURL(rel.Name), path)
+		if err == nil {
+			err = rel.verify(path)
+		}
+		if err == nil {
+			log.WithFields(logFields).Info("server jar taken from the cache")
+			return nil
+		}
+		log.WithFields(logFields).WithField("err", err).Warn("cached server jar is unusable, downloading")
+	}
+
+	log.WithFields(logFields).WithField("url", rel.URL).Info("downloading server jar")
+	err = rel.download(path)
+	if err != nil {
+		return err
+	}
+	err = S3Put(smc.jarCacheURL(rel.Name), path)
+	if err != nil {
+		log.WithFields(logFields).WithField("err", err).Warn("caching the server jar failed")
+	}
+	return nil
+}
+
+func (smc *SpotMC) jarCacheURL(name string) string {
+	return smc.cacheURL + "jars/" + name
+}
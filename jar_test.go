@@ -0,0 +1,136 @@
+package spotmc
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// jarFixture serves a Mojang version manifest and a Paper API.
+func jarFixture() *httptest.Server {
+	mux := http.NewServeMux()
+	var ts *httptest.Server
+
+	sum1 := sha1.Sum([]byte("vanilla 1.20.4"))
+	mux.HandleFunc("/mojang/version_manifest_v2.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"latest": {"release": "1.20.4", "snapshot": "24w03a"},
+			"versions": [
+				{"id": "24w03a", "type": "snapshot", "url": "%[1]s/mojang/24w03a.json"},
+				{"id": "1.20.4", "type": "release", "url": "%[1]s/mojang/1.20.4.json"}
+			]}`, ts.URL)
+	})
+	mux.HandleFunc("/mojang/1.20.4.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"downloads": {"server": {"sha1": "%s", "size": 14, "url": "%s/mojang/server.jar"}}}`,
+			hex.EncodeToString(sum1[:]), ts.URL)
+	})
+	mux.HandleFunc("/mojang/server.jar", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("vanilla 1.20.4"))
+	})
+
+	sum256 := sha256.Sum256([]byte("paper 1.20.4 435"))
+	mux.HandleFunc("/paper", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"versions": ["1.20.2", "1.20.4"]}`))
+	})
+	mux.HandleFunc("/paper/versions/1.20.4/builds", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"builds": [
+			{"build": 434, "channel": "default", "downloads": {"application": {"name": "paper-1.20.4-434.jar", "sha256": "00"}}},
+			{"build": 435, "channel": "default", "downloads": {"application": {"name": "paper-1.20.4-435.jar", "sha256": "%s"}}},
+			{"build": 436, "channel": "experimental", "downloads": {"application": {"name": "paper-1.20.4-436.jar", "sha256": "00"}}}
+		]}`, hex.EncodeToString(sum256[:]))
+	})
+	mux.HandleFunc("/paper/versions/1.20.4/builds/435/downloads/paper-1.20.4-435.jar", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("paper 1.20.4 435"))
+	})
+
+	ts = httptest.NewServer(mux)
+	return ts
+}
+
+func TestResolveJarSpec(t *testing.T) {
+	ts := jarFixture()
+	defer ts.Close()
+	mojangURL := ts.URL + "/mojang/version_manifest_v2.json"
+	paperURL := ts.URL + "/paper"
+
+	dir, err := ioutil.TempDir("", "jartest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for spec, expected := range map[string]string{
+		"mojang:1.20.4":         "mojang-1.20.4.jar",
+		"mojang:latest-release": "mojang-1.20.4.jar",
+		"paper:1.20.4:latest":   "paper-1.20.4-435.jar",
+		"paper:1.20.4:435":      "paper-1.20.4-435.jar",
+		"paper:latest":          "paper-1.20.4-435.jar",
+	} {
+		rel, err := resolveJarSpec(spec, mojangURL, paperURL)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+			continue
+		}
+		if rel.Name != expected {
+			t.Errorf("%s: got %s, expected %s", spec, rel.Name, expected)
+		}
+		err = rel.download(filepath.Join(dir, rel.Name))
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+		}
+	}
+
+	// Checksum mismatch
+	rel, err := resolveJarSpec("paper:1.20.4:434", mojangURL, paperURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel.URL = ts.URL + "/paper/versions/1.20.4/builds/435/downloads/paper-1.20.4-435.jar"
+	err = rel.download(filepath.Join(dir, "bad.jar"))
+	if err == nil {
+		t.Error("expected a checksum error")
+	}
+
+	for _, spec := range []string{"mojang:1.0.0", "paper:1.20.4:999", "forge:1.20.4"} {
+		_, err := resolveJarSpec(spec, mojangURL, paperURL)
+		if err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestGetJSONTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+	timeout := JAR_API_TIMEOUT
+	JAR_API_TIMEOUT = 50 * time.Millisecond
+	defer func() { JAR_API_TIMEOUT = timeout }()
+
+	var v interface{}
+	err := getJSON(ts.URL, &v)
+	if err == nil {
+		t.Error("a stalled API didn't time out")
+	}
+}
+
+func TestPinnedJarName(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"mojang:1.20.4":         "mojang-1.20.4.jar",
+		"mojang:latest-release": "",
+		"paper:1.20.4:435":      "paper-1.20.4-435.jar",
+		"paper:1.20.4:latest":   "",
+	} {
+		if name := pinnedJarName(spec); name != expected {
+			t.Errorf("%s: got %q, expected %q", spec, name, expected)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package spotmc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/goura/spotmc/archiver"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var DEFAULT_JAVA_CACHE_DIR = "/var/cache/spotmc/java"
+
+// How long a download by openURL() may take, body included
+var DOWNLOAD_TIMEOUT = 10 * time.Minute
+
+// Marks a runtime which was extracted completely
+var JAVA_RUNTIME_COMPLETE = ".spotmc-complete"
+
+var javaVersionPattern = regexp.MustCompile(`version "([0-9]+)(?:\.([0-9]+))?`)
+var mcVersionPattern = regexp.MustCompile(`(?:^|[^0-9])1\.([0-9]+)(?:\.([0-9]+))?`)
+
+// parseJavaVersion returns the major version from the output of
+// "java -version", like 8 for "1.8.0_292" and 17 for "17.0.2".
+func parseJavaVersion(output string) (int, error) {
+	m := javaVersionPattern.FindStringSubmatch(output)
+	if m == nil {
+		return 0, fmt.Errorf("no version in java -version output: %q", strings.TrimSpace(output))
+	}
+	major, _ := strconv.Atoi(m[1])
+	if major == 1 && m[2] != "" {
+		major, _ = strconv.Atoi(m[2])
+	}
+	return major, nil
+}
+
+// minJavaVersion returns the Java version a Minecraft server needs,
+// guessed from a version in the server name like "minecraft_server.1.20.4.jar".
+// It returns 0 if there's no version in the name.
+func minJavaVersion(serverVersion string) int {
+	m := mcVersionPattern.FindStringSubmatch(serverVersion)
+	if m == nil {
+		return 0
+	}
+	minor, _ := strconv.Atoi(m[1])
+	patch, _ := strconv.Atoi(m[2])
+	switch {
+	case minor > 20 || minor == 20 && patch >= 5:
+		return 21
+	case minor >= 18:
+		return 17
+	case minor == 17:
+		return 16
+	default:
+		return 8
+	}
+}
+
+// prepareJava() installs the Java runtime from SPOTMC_JAVA_RUNTIME_URL if
+// set, and checks that the Java to run the game server is new enough.
+func (smc *SpotMC) prepareJava() error {
+	if smc.javaRuntimeURL != "" {
+		javaPath, err := smc.installJavaRuntime()
+		if err != nil {
+			return err
+		}
+		smc.JavaPath = javaPath
+	}
+
+	minVersion := smc.javaMinVersion
+	if minVersion == 0 {
+		minVersion = minJavaVersion(smc.serverVersion())
+	}
+	if minVersion == 0 {
+		return nil
+	}
+
+	out, err := exec.Command(smc.JavaPath, "-version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running %s -version failed: %s", smc.JavaPath, err)
+	}
+	version, err := parseJavaVersion(string(out))
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"java": smc.JavaPath, "version": version, "minVersion": minVersion,
+	}).Info("java version checked")
+	if version < minVersion {
+		return fmt.Errorf("%s needs Java %d or later, but %s is Java %d. Set SPOTMC_JAVA_RUNTIME_URL or SPOTMC_JAVA_PATH to a newer Java",
+			smc.serverVersion(), minVersion, smc.JavaPath, version)
+	}
+	return nil
+}
+
+// installJavaRuntime() downloads the runtime archive, verifies its
+// checksum and extracts it under the cache dir, keyed by the checksum.
+// A runtime already in the cache is used as is.
+// It returns the path to the java command.
+func (smc *SpotMC) installJavaRuntime() (string, error) {
+	dir := filepath.Join(smc.javaCacheDir, smc.javaRuntimeSHA256)
+	logFields := log.Fields{"url": smc.javaRuntimeURL, "dir": dir}
+
+	_, err := os.Stat(filepath.Join(dir, JAVA_RUNTIME_COMPLETE))
+	if err == nil {
+		log.WithFields(logFields).Info("using cached java runtime")
+		return findJava(dir)
+	}
+
+	log.WithFields(logFields).Info("downloading java runtime")
+	err = os.MkdirAll(smc.javaCacheDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(smc.javaCacheDir, "download")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	r, err := openURL(smc.javaRuntimeURL)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != smc.javaRuntimeSHA256 {
+		return "", fmt.Errorf("java runtime checksum mismatch: expected %s, got %s", smc.javaRuntimeSHA256, sum)
+	}
+
+	// Start over if a previous extraction was interrupted
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	err = archiver.Extract(f, dir, archiver.Options{})
+	if err != nil {
+		return "", err
+	}
+	javaPath, err := findJava(dir)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, JAVA_RUNTIME_COMPLETE), nil, 0644)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(logFields).Info("java runtime installed")
+	return javaPath, nil
+}
+
+// findJava returns bin/java in dir or in its top level directory,
+// as JDK archives usually have one like "jdk-21.0.2+13/".
+func findJava(dir string) (string, error) {
+	candidates := []string{filepath.Join(dir, "bin", "java")}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*", "bin", "java"))
+	candidates = append(candidates, matches...)
+	for _, path := range candidates {
+		fi, err := os.Stat(path)
+		if err == nil && fi.Mode().IsRegular() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no bin/java in the java runtime at %s", dir)
+}
+
+// openURL opens an s3:// or http(s):// URL for reading.
+func openURL(url string) (io.ReadCloser, error) {
+	if strings.HasPrefix(url, "s3://") {
+		body, _, err := S3GetStream(url)
+		return body, err
+	}
+	cli := http.Client{Timeout: DOWNLOAD_TIMEOUT}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,72 @@
+package spotmc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseJavaVersion(t *testing.T) {
+	for output, expected := range map[string]int{
+		`openjdk version "1.8.0_292"
+OpenJDK Runtime Environment (build 1.8.0_292-b10)`: 8,
+		`openjdk version "17.0.2" 2022-01-18`:      17,
+		`java version "21" 2023-09-19`:             21,
+		`openjdk version "11.0.22" 2024-01-16 LTS`: 11,
+	} {
+		v, err := parseJavaVersion(output)
+		if err != nil {
+			t.Errorf("%q: %s", output, err)
+			continue
+		}
+		if v != expected {
+			t.Errorf("%q: got %d, expected %d", output, v, expected)
+		}
+	}
+
+	_, err := parseJavaVersion("bash: java: command not found")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestMinJavaVersion(t *testing.T) {
+	for name, expected := range map[string]int{
+		"minecraft_server.1.8.1.jar":  8,
+		"minecraft_server.1.16.5.jar": 8,
+		"minecraft_server.1.17.1.jar": 16,
+		"paper-1.20.4-435.jar":        17,
+		"minecraft_server.1.20.5.jar": 21,
+		"minecraft_server.1.21.jar":   21,
+		"server.jar":                  0,
+	} {
+		if v := minJavaVersion(name); v != expected {
+			t.Errorf("%s: got %d, expected %d", name, v, expected)
+		}
+	}
+}
+
+func TestOpenURLTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+		// The body stalls after the headers
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+	timeout := DOWNLOAD_TIMEOUT
+	DOWNLOAD_TIMEOUT = 50 * time.Millisecond
+	defer func() { DOWNLOAD_TIMEOUT = timeout }()
+
+	body, err := openURL(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	_, err = ioutil.ReadAll(body)
+	if err == nil {
+		t.Error("a stalled download didn't time out")
+	}
+}
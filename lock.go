@@ -0,0 +1,191 @@
+package spotmc
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"time"
+)
+
+var LOCK_SUFFIX = ".lock"
+var LOCK_SETTLE_TIME = 3 * time.Second
+
+// lease is the content of the lock object placed next to SPOTMC_DATA_URL.
+// Whoever holds a lease that hasn't expired owns the world data.
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *lease) heldByOther(holder string, now time.Time) bool {
+	return l.Holder != holder && now.Before(l.Expires)
+}
+
+func lockURL(dataFileURL string) string {
+	return dataFileURL + LOCK_SUFFIX
+}
+
+// lockHolderID identifies this process in the lease.
+// Outside of EC2 the hostname is used instead of the instance ID.
+func lockHolderID() string {
+	id, err := InstanceID()
+	if err == nil && id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// readLease returns nil without an error when there's no lock object.
+func readLease(url string) (*lease, error) {
+	data, err := S3GetBytes(url)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	l := &lease{}
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, fmt.Errorf("broken lock object %s: %s", url, err)
+	}
+	return l, nil
+}
+
+func (smc *SpotMC) writeLease() error {
+	l := lease{
+		Holder:  smc.lockHolder,
+		Expires: time.Now().Add(time.Duration(smc.lockTTL) * time.Second),
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return S3PutBytes(lockURL(smc.DataFileURL), data)
+}
+
+// acquireLock() takes the lease on the world data, or fails if
+// another live instance holds it.
+// S3 has no compare-and-swap, so after writing the lease we wait a bit
+// and read it back to detect a racing instance.
+func (smc *SpotMC) acquireLock() error {
+	url := lockURL(smc.DataFileURL)
+	l, err := readLease(url)
+	if err != nil {
+		return err
+	}
+	if l != nil && l.heldByOther(smc.lockHolder, time.Now()) {
+		return fmt.Errorf("world data is locked by %s until %s (use force-unlock to override)",
+			l.Holder, l.Expires.Format(time.RFC3339))
+	}
+
+	err = smc.writeLease()
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(LOCK_SETTLE_TIME)
+	l, err = readLease(url)
+	if err != nil {
+		return err
+	}
+	if l == nil || l.Holder != smc.lockHolder {
+		return fmt.Errorf("lost the race for the world data lock")
+	}
+
+	log.WithFields(log.Fields{
+		"url": url, "holder": l.Holder, "expires": l.Expires,
+	}).Info("world data lock acquired")
+	return nil
+}
+
+// checkLock() makes sure the lease is still ours.
+// It is called before overwriting the world data.
+func (smc *SpotMC) checkLock() error {
+	l, err := readLease(lockURL(smc.DataFileURL))
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return fmt.Errorf("world data lock has disappeared")
+	}
+	if l.Holder != smc.lockHolder {
+		return fmt.Errorf("world data lock is now held by %s", l.Holder)
+	}
+	return nil
+}
+
+// releaseLock() deletes the lock object if it's still ours.
+func (smc *SpotMC) releaseLock() error {
+	err := smc.checkLock()
+	if err != nil {
+		return err
+	}
+	return S3Delete(lockURL(smc.DataFileURL))
+}
+
+// lockHeartbeat() keeps extending the lease while the game server runs.
+// If someone else took the lock, or it was removed by force-unlock, it
+// stops, and putDataDir will refuse to save.
+func (smc *SpotMC) lockHeartbeat() {
+	d := time.Duration(smc.lockTTL) * time.Second / 3
+	for {
+		time.Sleep(d)
+		l, err := readLease(lockURL(smc.DataFileURL))
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("reading world data lock failed")
+			continue
+		}
+		if l == nil {
+			log.Error("world data lock has disappeared, stop heartbeating")
+			return
+		}
+		if l.heldByOther(smc.lockHolder, time.Now()) {
+			log.WithFields(log.Fields{
+				"holder": l.Holder,
+			}).Error("world data lock was taken by another instance, stop heartbeating")
+			return
+		}
+		err = smc.writeLease()
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("extending world data lock failed")
+			continue
+		}
+		log.Debug("world data lock extended")
+	}
+}
+
+// ForceUnlock removes the lock object regardless of its holder.
+// It's meant for manual recovery after an instance died without releasing it.
+// The lock of world is removed, or of SPOTMC_WORLD's if world is "".
+func ForceUnlock(world string) error {
+	dataFileURL, _, err := worldDataURL(world)
+	if err != nil {
+		return err
+	}
+	if dataFileURL == "" {
+		return fmt.Errorf("set SPOTMC_DATA_URL or SPOTMC_WORLDS_URL")
+	}
+
+	url := lockURL(dataFileURL)
+	l, err := readLease(url)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		log.WithFields(log.Fields{"url": url}).Info("world data is not locked")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"url": url, "holder": l.Holder, "expires": l.Expires,
+		"live": time.Now().Before(l.Expires),
+	}).Warn("removing world data lock")
+	return S3Delete(url)
+}
@@ -0,0 +1,143 @@
+package spotmc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newLockTestSpotMC(holder string) *SpotMC {
+	return &SpotMC{
+		DataFileURL: "s3://bucket/data.tgz",
+		lockHolder:  holder,
+		lockTTL:     1,
+	}
+}
+
+func putLease(fake *fakeS3, holder string, expires time.Time) {
+	data, _ := json.Marshal(lease{Holder: holder, Expires: expires})
+	fake.put("s3://bucket/data.tgz.lock", string(data))
+}
+
+func TestLock(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	settle := LOCK_SETTLE_TIME
+	LOCK_SETTLE_TIME = 0
+	defer func() { LOCK_SETTLE_TIME = settle }()
+
+	a := newLockTestSpotMC("i-a")
+	b := newLockTestSpotMC("i-b")
+	err := a.acquireLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.checkLock(); err != nil {
+		t.Error(err)
+	}
+
+	// Conflict
+	err = b.acquireLock()
+	if err == nil {
+		t.Fatal("acquired a lock held by another instance")
+	}
+	if err := b.releaseLock(); err == nil {
+		t.Error("released a lock held by another instance")
+	}
+
+	// Expiry
+	putLease(fake, "i-a", time.Now().Add(-time.Second))
+	err = b.acquireLock()
+	if err != nil {
+		t.Fatal("couldn't take an expired lock", err)
+	}
+	if err := a.checkLock(); err == nil {
+		t.Error("the lock taken over is still ours")
+	}
+
+	// Release
+	err = b.releaseLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := readLease(lockURL(b.DataFileURL)); l != nil {
+		t.Errorf("lock is left: %v", l)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	os.Setenv("SPOTMC_DATA_URL", "s3://bucket/data.tgz")
+	defer os.Unsetenv("SPOTMC_DATA_URL")
+
+	a := newLockTestSpotMC("i-a")
+	putLease(fake, "i-a", time.Now().Add(time.Hour))
+	err := ForceUnlock("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := readLease(lockURL(a.DataFileURL)); l != nil {
+		t.Fatalf("lock is left: %v", l)
+	}
+
+	// The heartbeat must not bring the lock back
+	done := make(chan bool)
+	go func() {
+		a.lockHeartbeat()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("heartbeat didn't stop")
+	}
+	if l, _ := readLease(lockURL(a.DataFileURL)); l != nil {
+		t.Errorf("heartbeat recreated the lock: %v", l)
+	}
+	if err := a.checkLock(); err == nil {
+		t.Error("the force-unlocked lock is still ours")
+	}
+}
+
+func TestForceUnlockWorld(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	os.Setenv("SPOTMC_WORLDS_URL", "s3://bucket/worlds")
+	defer os.Unsetenv("SPOTMC_WORLDS_URL")
+	fake.put("s3://bucket/worlds/default/data.tgz.lock", "{}")
+	fake.put("s3://bucket/worlds/creative/data.tgz.lock", "{}")
+
+	err := ForceUnlock("creative")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.get("s3://bucket/worlds/creative/data.tgz.lock") != "" {
+		t.Error("lock of the world is left")
+	}
+	if fake.get("s3://bucket/worlds/default/data.tgz.lock") == "" {
+		t.Error("lock of another world was removed")
+	}
+}
+
+func TestLockHolderID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("i-0123"))
+	}))
+	orig := INSTANCE_ID_URL
+	defer func() { INSTANCE_ID_URL = orig }()
+	INSTANCE_ID_URL = ts.URL
+	if id := lockHolderID(); id != "i-0123" {
+		t.Errorf("got %q", id)
+	}
+
+	// Outside of EC2
+	ts.Close()
+	host, _ := os.Hostname()
+	if id := lockHolderID(); id != host {
+		t.Errorf("got %q, expected the hostname %q", id, host)
+	}
+}
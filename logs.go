@@ -0,0 +1,266 @@
+package spotmc
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DEFAULT_LOG_DIR = "/var/log/spotmc"
+var LOGS_SUFFIX = ".logs/"
+var DEFAULT_LOG_MAX_SIZE = 10 // MiB
+var DEFAULT_LOG_MAX_FILES = 5
+var DEFAULT_LOG_UPLOAD_INTERVAL = 300
+
+var SPOTMC_LOG_FILE = "spotmc.log"
+var CONSOLE_LOG_FILE = "console.log"
+
+// rotatingFile is a log file which is renamed to .1, .2 and so on once
+// it grows past max bytes, keeping at most keep files in all.
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	keep int
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(path string, max int64, keep int) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, max: max, keep: keep, f: f, size: fi.Size()}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.max {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep-1))
+	for i := r.keep - 2; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.keep > 1 {
+		os.Rename(r.path, r.path+".1")
+	}
+	r.f, err = os.OpenFile(r.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	r.size = 0
+	return err
+}
+
+// startLogCapture() writes spotmc's log and the game server console to
+// rotating files in a dir of this session, which uploadLogs() puts under
+// SPOTMC_LOGS_URL. Nothing is captured if SPOTMC_LOG_DIR is empty.
+func (smc *SpotMC) startLogCapture() error {
+	if smc.logDir == "" {
+		return nil
+	}
+	smc.sessionID = time.Now().UTC().Format("20060102T150405Z")
+	if id, err := InstanceID(); err == nil {
+		smc.sessionID += "-" + id
+	}
+	dir := filepath.Join(smc.logDir, smc.sessionID)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	max := int64(smc.logMaxSize) * 1024 * 1024
+	spotmcLog, err := newRotatingFile(filepath.Join(dir, SPOTMC_LOG_FILE), max, smc.logMaxFiles)
+	if err != nil {
+		return err
+	}
+	consoleLog, err := newRotatingFile(filepath.Join(dir, CONSOLE_LOG_FILE), max, smc.logMaxFiles)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, spotmcLog))
+	smc.consoleLog = consoleLog
+	log.WithFields(log.Fields{
+		"session": smc.sessionID,
+		"dir":     dir,
+		"url":     smc.sessionLogsURL(),
+	}).Info("capturing logs")
+	return nil
+}
+
+// logsURL returns SPOTMC_LOGS_URL, or the prefix next to the world data.
+func logsURL(dataFileURL string) string {
+	if s := os.Getenv("SPOTMC_LOGS_URL"); s != "" {
+		return strings.TrimSuffix(s, "/") + "/"
+	}
+	return dataFileURL + LOGS_SUFFIX
+}
+
+func (smc *SpotMC) sessionLogsURL() string {
+	return smc.logsURL + smc.sessionID + "/"
+}
+
+// logUploader() uploads the logs every SPOTMC_LOG_UPLOAD_INTERVAL, so
+// that not much is lost if the instance vanishes.
+func (smc *SpotMC) logUploader() {
+	if smc.sessionID == "" || smc.logUpload <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(smc.logUpload) * time.Second)
+		smc.uploadLogs()
+	}
+}
+
+// uploadLogs() puts the log files of this session and the crash reports
+// of the game server under the session prefix, skipping those which
+// haven't changed since the last upload.
+func (smc *SpotMC) uploadLogs() {
+	if smc.sessionID == "" {
+		return
+	}
+	smc.logUploadMu.Lock()
+	defer smc.logUploadMu.Unlock()
+	if smc.logsUploaded == nil {
+		smc.logsUploaded = map[string]string{}
+	}
+
+	files := map[string]string{}
+	dir := filepath.Join(smc.logDir, smc.sessionID)
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		files[fi.Name()] = filepath.Join(dir, fi.Name())
+	}
+	if smc.dataDirPath != "" {
+		reports, _ := filepath.Glob(filepath.Join(smc.dataDirPath, "crash-reports", "*.txt"))
+		for _, p := range reports {
+			files["crash-reports/"+filepath.Base(p)] = p
+		}
+	}
+
+	n := 0
+	for name, p := range files {
+		data, stamp, err := readLogSnapshot(p)
+		if err != nil || smc.logsUploaded[name] == stamp {
+			continue
+		}
+		err = S3PutBytes(smc.sessionLogsURL()+name, data)
+		if err != nil {
+			log.WithFields(log.Fields{"path": p, "err": err}).Warn("uploading log failed")
+			continue
+		}
+		smc.logsUploaded[name] = stamp
+		n++
+	}
+	if n > 0 {
+		log.WithFields(log.Fields{"files": n, "url": smc.sessionLogsURL()}).Info("logs uploaded")
+	}
+}
+
+// readLogSnapshot reads a log file up to the size it has now, as it keeps
+// growing while it's read, and returns a stamp which changes with it.
+func readLogSnapshot(path string) ([]byte, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, "", fmt.Errorf("not a regular file: %s", path)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, fi.Size()))
+	if err != nil {
+		return nil, "", err
+	}
+	return data, fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// LogsCommand lists the sessions with logs under SPOTMC_LOGS_URL, the
+// files of a session, or prints a file.
+func LogsCommand(args []string) error {
+	// Only where the logs are is needed, not the config of a server
+	err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	dataFileURL, _, err := worldDataURL("")
+	if err != nil {
+		return err
+	}
+	url := logsURL(dataFileURL)
+	if url == LOGS_SUFFIX {
+		return fmt.Errorf("set SPOTMC_LOGS_URL, SPOTMC_DATA_URL or SPOTMC_WORLDS_URL")
+	}
+	keys, err := S3List(url)
+	if err != nil {
+		return err
+	}
+
+	switch len(args) {
+	case 0:
+		seen := map[string]bool{}
+		var sessions []string
+		for _, k := range keys {
+			parts := strings.SplitN(k, "/", 2)
+			if len(parts) == 2 && !seen[parts[0]] {
+				seen[parts[0]] = true
+				sessions = append(sessions, parts[0])
+			}
+		}
+		sort.Strings(sessions)
+		for _, s := range sessions {
+			fmt.Println(s)
+		}
+		return nil
+	case 1:
+		found := false
+		for _, k := range keys {
+			if strings.HasPrefix(k, args[0]+"/") {
+				fmt.Println(strings.TrimPrefix(k, args[0]+"/"))
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no logs for session %s", args[0])
+		}
+		return nil
+	case 2:
+		body, _, err := S3GetStream(url + args[0] + "/" + args[1])
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = io.Copy(os.Stdout, body)
+		return err
+	}
+	return fmt.Errorf("usage: spotmc logs [session] [file]")
+}
@@ -0,0 +1,97 @@
+package spotmc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "console.log")
+
+	r, err := newRotatingFile(path, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		_, err = r.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]string{
+		"console.log":   "line 4\n",
+		"console.log.1": "line 3\n",
+		"console.log.2": "line 2\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("more files than kept")
+	}
+
+	// Appends to what's there after a restart
+	r, err = newRotatingFile(path, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("5\n"))
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "line 4\n5\n" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestUploadLogs(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "s1"), 0755)
+	path := filepath.Join(dir, "s1", CONSOLE_LOG_FILE)
+	ioutil.WriteFile(path, []byte("line 1\n"), 0644)
+
+	smc := &SpotMC{logDir: dir, sessionID: "s1", logsURL: "s3://bucket/logs/"}
+	smc.uploadLogs()
+	if got := fake.get("s3://bucket/logs/s1/console.log"); got != "line 1\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// Unchanged files aren't uploaded again
+	puts := fake.puts
+	smc.uploadLogs()
+	if fake.puts != puts {
+		t.Error("unchanged log uploaded again")
+	}
+}
+
+func TestLogsCommandWithoutServerConfig(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	fake.put("s3://bucket/data.tgz.logs/s1/console.log", "line 1\n")
+
+	// Only the data URL is set, none of what the server needs
+	os.Setenv("SPOTMC_DATA_URL", "s3://bucket/data.tgz")
+	defer os.Unsetenv("SPOTMC_DATA_URL")
+	err := LogsCommand([]string{"s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LogsCommand([]string{"s2"})
+	if err == nil || !strings.Contains(err.Error(), "no logs for session") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"os"
-	"os/signal"
-	"syscall"
 )
 
 func Main() {
@@ -15,20 +13,41 @@ func Main() {
 		log.Fatal(err)
 		os.Exit(1)
 	}
+	smc, err = selectWorld(smc)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	if smc.world != "" {
+		log.WithFields(log.Fields{"world": smc.world, "url": smc.DataFileURL}).Info("world selected")
+	}
+
+	// Keep the logs of this session
+	err = smc.startLogCapture()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("capturing logs failed, logging to stderr only")
+	}
+	go smc.logUploader()
 
 	// Update DDNS
 	smc.updateDDNS()
 
-	// Get game server jar file
-	log.Info("retrieving game server jar file")
-	_, err = smc.getJarFile()
+	// Get the game server, and Java for the ones which need it
+	log.WithFields(log.Fields{"game": smc.game}).Info("retrieving game server")
+	err = smc.profile.Fetch(smc)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	log.WithFields(log.Fields{
-		"path": smc.serverPath,
-	}).Info("game server jar file retrieved")
+
+	// Lock the world data so that no other instance restores or saves it
+	log.Info("acquiring world data lock")
+	err = smc.acquireLock()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	go smc.lockHeartbeat()
 
 	// Get the data dir from S3
 	log.Info("retrieving data directory")
@@ -41,39 +60,52 @@ func Main() {
 		"path": smc.dataDirPath,
 	}).Info("data directory archive file retrieved")
 
+	// Set up the data dir for the game, like plugins, server.properties
+	// and player lists for Minecraft
+	if smc.profile.Prepare != nil {
+		err = smc.profile.Prepare(smc)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+
 	// Run game server
 	log.Printf("starting the game server")
-	cmd, err := smc.startServer()
+	err = smc.launchServer()
 	if err != nil {
-		err = fmt.Errorf("game server did not start: %s", err)
+		log.WithFields(log.Fields{
+			"err": fmt.Errorf("game server did not start: %s", err),
+		}).Error("starting the game server failed")
+		go func() {
+			smc.msgs <- msgGameServerDown
+		}()
+	} else if smc.readyPattern == nil {
+		smc.serverReady()
 	}
 
-	// Spawn watch proc which waits for the game server to end
-	go func() {
-		err = cmd.Wait()
-		log.Info("game server process exited")
-		smc.msgs <- msgGameServerDown
-	}()
-
-	// Spawn a SIGTERM handler
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGTERM)
-	go func() {
-		<-sigchan
-		smc.msgs <- msgInstanceTerminating
-	}()
+	// Spawn the signal handler
+	go smc.handleSignals()
 
 	// Spawn other watchers
 	go smc.idleWatcher()
 	go smc.uptimeWatcher()
 	go smc.terminationNotificationWatcher()
+	go smc.watchdog()
+	if smc.profile.Watch != nil {
+		go smc.profile.Watch(smc)
+	}
 
 	// Start the main loop
+	exitCode := 0
+	stopping := false
 	for {
 		msg := <-smc.msgs
-		if msg == msgInstanceTerminating {
-			log.Info("killing the game server")
-			cmd.Process.Kill()
+		if msg == msgInstanceTerminating && !stopping {
+			stopping = true
+			smc.setStopping("stopping the game server")
+			log.Info("stopping the game server")
+			smc.stopServer()
 		}
 		if msg == msgShutdownCluster {
 			log.Info("shutting down the cluster")
@@ -87,20 +119,73 @@ func Main() {
 				smc.msgs <- msgInstanceTerminating
 			}()
 		}
+		if msg == msgRestartServer {
+			if stopping {
+				// Stopped while waiting to restart, just save
+				msg = msgGameServerDown
+			} else {
+				log.Info("restarting the game server")
+				err := smc.launchServer()
+				if err != nil {
+					log.WithFields(log.Fields{"err": err}).Error("restarting the game server failed")
+					msg = msgGameServerDown
+				} else {
+					sdNotify(smc.status("game server restarted"))
+				}
+			}
+		}
+		if msg == msgGameServerDown && !stopping && smc.lastExit != nil && smc.lastExit.crashed() {
+			// Give the game server another chance, unless it keeps crashing
+			if smc.scheduleRestart() {
+				continue
+			}
+		}
 		if msg == msgGameServerDown {
 			// If the game server ends, the instance dies
+			smc.setStopping("saving data")
 
-			// Save data to S3
+			// Save data to S3, after a backup in progress if any
 			log.Info("saving data to S3 started")
-			err := smc.putDataDir()
-			if err != nil {
+			smc.saveMu.Lock()
+			err := smc.saveData()
+			smc.saveMu.Unlock()
+			if err == errSaveConflict {
+				// The data is kept in the conflict snapshot. The lock
+				// was still ours (checkLock passed before the save), so
+				// release it as after a good save, or it would keep the
+				// next instance out until it expires.
 				log.WithFields(log.Fields{
 					"err": err,
-				}).Fatal("saving data to S3 failed")
+				}).Error("saving data to S3 conflicted")
+				exitCode = EXIT_SAVE_FAILED
+				err = smc.releaseLock()
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Warn("releasing world data lock failed")
+				}
+			} else if err != nil {
+				// Keep the instance, the data dir is the only copy
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("saving data to S3 failed")
+				smc.uploadLogs()
+				os.Exit(EXIT_SAVE_FAILED)
 			} else {
 				log.Info("saving data to S3 done")
+
+				// Let the next instance take over the world data
+				err = smc.releaseLock()
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Warn("releasing world data lock failed")
+				}
 			}
 
+			// Last chance for the logs before the instance goes away
+			smc.uploadLogs()
+
 			// Kill instance
 			smc.killInstance()
 
@@ -108,4 +193,5 @@ func Main() {
 			break
 		}
 	}
+	os.Exit(exitCode)
 }
@@ -0,0 +1,177 @@
+package spotmc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var MANIFEST_SUFFIX = ".manifest.json"
+
+// manifest describes a saved snapshot of the data dir.
+// It's stored next to the archive and checked on restore so that
+// a corrupted or half-written snapshot is never used to start the server.
+type manifest struct {
+	ArchiveSHA256 string            `json:"archive_sha256"`
+	ArchiveSize   int64             `json:"archive_size"`
+	ArchiveETag   string            `json:"archive_etag,omitempty"`
+	Compression   string            `json:"compression,omitempty"`
+	FileCount     int               `json:"file_count"`
+	Files         map[string]string `json:"files"`
+	ServerVersion string            `json:"server_version"`
+	World         string            `json:"world,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+func manifestURL(dataFileURL string) string {
+	return dataFileURL + MANIFEST_SUFFIX
+}
+
+func fileSHA256(path string) (sum string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// hashDir returns the SHA-256 of every regular file under dir,
+// keyed by slash separated paths relative to dir.
+func hashDir(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, _, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func newManifest(files map[string]string, archive *hashCounter, compression, serverVersion string) *manifest {
+	return &manifest{
+		ArchiveSHA256: archive.Sum(),
+		ArchiveSize:   archive.n,
+		Compression:   compression,
+		FileCount:     len(files),
+		Files:         files,
+		ServerVersion: serverVersion,
+		CreatedAt:     time.Now().UTC(),
+	}
+}
+
+// getManifest returns nil without an error for snapshots saved
+// before manifests were introduced.
+func getManifest(dataFileURL string, env *envelope) (*manifest, error) {
+	data, err := S3GetBytes(manifestURL(dataFileURL))
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// The file list tells player UUIDs, so it's encrypted like the archive
+	data, err = env.open(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("broken manifest: %s", err)
+	}
+	return m, nil
+}
+
+func putManifest(dataFileURL string, m *manifest, env *envelope) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data, err = env.seal(data)
+	if err != nil {
+		return err
+	}
+	return S3PutBytes(manifestURL(dataFileURL), data)
+}
+
+// stale tells whether m was written for another archive than the one
+// with etag. The archive is uploaded before its manifest, so an instance
+// lost in between leaves the new archive next to the old manifest.
+// Manifests saved before the ETag was recorded are never stale.
+func (m *manifest) stale(etag string) bool {
+	return m.ArchiveETag != "" && m.ArchiveETag != etag
+}
+
+// verifyArchive checks the downloaded archive stream against the manifest.
+func (m *manifest) verifyArchive(archive *hashCounter) error {
+	if archive.n != m.ArchiveSize {
+		return fmt.Errorf("archive size mismatch: expected %d, got %d", m.ArchiveSize, archive.n)
+	}
+	if sum := archive.Sum(); sum != m.ArchiveSHA256 {
+		return fmt.Errorf("archive checksum mismatch: expected %s, got %s", m.ArchiveSHA256, sum)
+	}
+	return nil
+}
+
+// verifyDir checks the extracted data dir against the manifest.
+// Missing, extra and modified files are all reported.
+func (m *manifest) verifyDir(dataDirPath string) error {
+	files, err := hashDir(dataDirPath)
+	if err != nil {
+		return err
+	}
+
+	var bad []string
+	for name, sum := range m.Files {
+		got, ok := files[name]
+		if !ok {
+			bad = append(bad, "missing: "+name)
+		} else if got != sum {
+			bad = append(bad, "modified: "+name)
+		}
+	}
+	for name := range files {
+		if _, ok := m.Files[name]; !ok {
+			bad = append(bad, "unexpected: "+name)
+		}
+	}
+	if len(files) != m.FileCount {
+		bad = append(bad, fmt.Sprintf("file count: expected %d, got %d", m.FileCount, len(files)))
+	}
+
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("extracted data doesn't match the manifest: %v", bad)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package spotmc
+
+import (
+	"bytes"
+	"github.com/goura/spotmc/archiver"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManifestVerify(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	err = os.MkdirAll(dataDir+"/world/region", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(dataDir+"/eula.txt", []byte("eula=true\n"), 0644)
+	ioutil.WriteFile(dataDir+"/world/region/r.0.0.mca", []byte("region"), 0644)
+
+	// Archive
+	var buf bytes.Buffer
+	hc := newHashCounter()
+	files, err := archiver.Write(io.MultiWriter(&buf, hc), dataDir, archiver.Options{Compression: "zstd", Level: -1})
+	if err != nil {
+		t.Fatal("archiver.Write failed", err)
+	}
+	m := newManifest(files, hc, "zstd", "minecraft_server.1.8.1.jar")
+	if m.FileCount != 2 {
+		t.Fatalf("FileCount doesn't match: %d", m.FileCount)
+	}
+	if _, ok := m.Files["world/region/r.0.0.mca"]; !ok {
+		t.Fatalf("region file is not in the manifest: %v", m.Files)
+	}
+
+	// Restore
+	restoreDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(restoreDir)
+
+	hc2 := newHashCounter()
+	r := io.TeeReader(bytes.NewReader(buf.Bytes()), hc2)
+	err = archiver.Extract(r, restoreDir, archiver.Options{})
+	if err != nil {
+		t.Fatal("archiver.Extract failed", err)
+	}
+	io.Copy(ioutil.Discard, r)
+
+	err = m.verifyArchive(hc2)
+	if err != nil {
+		t.Fatal("verifyArchive failed", err)
+	}
+	err = m.verifyDir(restoreDir)
+	if err != nil {
+		t.Fatal("verifyDir failed", err)
+	}
+
+	// Truncated extraction must be detected
+	os.Remove(restoreDir + "/world/region/r.0.0.mca")
+	err = m.verifyDir(restoreDir)
+	if err == nil {
+		t.Fatal("verifyDir didn't detect a missing file")
+	}
+
+	// So must a corrupted archive
+	hc3 := newHashCounter()
+	hc3.Write(buf.Bytes()[1:])
+	err = m.verifyArchive(hc3)
+	if err == nil {
+		t.Fatal("verifyArchive didn't detect a modified archive")
+	}
+}
+
+// A save lost between the archive and the manifest upload leaves the
+// new archive next to the old manifest
+func TestRestoreTgzStaleManifest(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	ioutil.WriteFile(src+"/level.dat", []byte("new"), 0644)
+	var buf bytes.Buffer
+	_, err = archiver.Write(&buf, src, archiver.Options{Compression: "gzip", Level: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	smc := &SpotMC{DataFileURL: "s3://bucket/data.tgz", envelope: &envelope{}}
+	fake.put(smc.DataFileURL, buf.String())
+	etag, _ := fake.HeadETag(smc.DataFileURL)
+
+	old := &manifest{
+		ArchiveSHA256: "old", ArchiveSize: 1, Compression: "zstd",
+		FileCount: 1, Files: map[string]string{"level.dat": "old"},
+	}
+	for _, c := range []struct {
+		etag    string
+		success bool
+	}{
+		{"\"previous\"", true},
+		// Recorded for this archive, so the mismatch is real
+		{etag, false},
+		// Saved before ETags were recorded
+		{"", false},
+	} {
+		old.ArchiveETag = c.etag
+		putManifest(smc.DataFileURL, old, smc.envelope)
+		dst, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		_, err = smc.restoreTgz(dst)
+		if (err == nil) != c.success {
+			t.Errorf("manifest etag %q: got %v", c.etag, err)
+		}
+		if c.success {
+			if data, _ := ioutil.ReadFile(dst + "/level.dat"); string(data) != "new" {
+				t.Errorf("got %q", data)
+			}
+		}
+	}
+}
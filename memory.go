@@ -0,0 +1,215 @@
+package spotmc
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var MEMINFO_PATH = "/proc/meminfo"
+
+// The cgroup of the process is looked up in PROC_CGROUP_PATH and its
+// memory limit read under CGROUP_ROOT, from cgroup v2 or v1
+var PROC_CGROUP_PATH = "/proc/self/cgroup"
+var CGROUP_ROOT = "/sys/fs/cgroup"
+
+// Without SPOTMC_MEMORY_HEADROOM, a quarter of the memory (but at least
+// MEMORY_HEADROOM_MIN) is left for the OS, spotmc and the JVM's off-heap memory
+var MEMORY_HEADROOM_RATIO = 0.25
+var MEMORY_HEADROOM_MIN = int64(512 * 1024 * 1024)
+var HEAP_MIN = int64(512 * 1024 * 1024)
+
+// Above this heap size the G1 preset uses larger regions and young gen
+var G1_LARGE_HEAP = int64(12 * 1024 * 1024 * 1024)
+
+// GC flag presets for SPOTMC_GC_PRESET. "g1" are the G1 flags widely used
+// for Minecraft servers (Aikar's flags).
+var gcPresets = map[string]func(heap int64) []string{
+	"none": func(heap int64) []string { return nil },
+	"g1": func(heap int64) []string {
+		newSize, maxNewSize, region, reserve, ihop := 30, 40, "8M", 20, 15
+		if heap > G1_LARGE_HEAP {
+			newSize, maxNewSize, region, reserve, ihop = 40, 50, "16M", 15, 20
+		}
+		return []string{
+			"-XX:+UseG1GC",
+			"-XX:+ParallelRefProcEnabled",
+			"-XX:MaxGCPauseMillis=200",
+			"-XX:+UnlockExperimentalVMOptions",
+			"-XX:+DisableExplicitGC",
+			"-XX:+AlwaysPreTouch",
+			fmt.Sprintf("-XX:G1NewSizePercent=%d", newSize),
+			fmt.Sprintf("-XX:G1MaxNewSizePercent=%d", maxNewSize),
+			"-XX:G1HeapRegionSize=" + region,
+			fmt.Sprintf("-XX:G1ReservePercent=%d", reserve),
+			"-XX:G1HeapWastePercent=5",
+			"-XX:G1MixedGCCountTarget=4",
+			fmt.Sprintf("-XX:InitiatingHeapOccupancyPercent=%d", ihop),
+			"-XX:G1MixedGCLiveThresholdPercent=90",
+			"-XX:G1RSetUpdatingPauseTimePercent=5",
+			"-XX:SurvivorRatio=32",
+			"-XX:+PerfDisableSharedMem",
+			"-XX:MaxTenuringThreshold=1",
+		}
+	},
+}
+
+// parseMeminfo returns MemTotal of /proc/meminfo in bytes.
+func parseMeminfo(r io.Reader) (int64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemTotal not found")
+}
+
+// parseCgroupLimit parses memory.max or memory.limit_in_bytes.
+// It returns 0 for no limit.
+func parseCgroupLimit(s string) int64 {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	// cgroup v1 reports "unlimited" as a huge number
+	if err != nil || n <= 0 || n >= 1<<60 {
+		return 0
+	}
+	return n
+}
+
+// parseProcCgroup returns the cgroup v2 path and the cgroup v1 memory
+// controller path of /proc/self/cgroup, "" for those not there.
+func parseProcCgroup(r io.Reader) (v2, v1 string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			v2 = fields[2]
+		}
+		for _, c := range strings.Split(fields[1], ",") {
+			if c == "memory" {
+				v1 = fields[2]
+			}
+		}
+	}
+	return v2, v1, scanner.Err()
+}
+
+// cgroupLimitPaths returns the memory limit files of the cgroups of the
+// process and of their parents, as a limit on a slice applies to all in it.
+// Without /proc/self/cgroup only the root ones are read.
+func cgroupLimitPaths() []string {
+	v2, v1 := "/", "/"
+	f, err := os.Open(PROC_CGROUP_PATH)
+	if err == nil {
+		v2, v1, _ = parseProcCgroup(f)
+		f.Close()
+	}
+
+	var paths []string
+	add := func(dir, cgroup, file string) {
+		if cgroup == "" {
+			return
+		}
+		for p := path.Clean(cgroup); ; p = path.Dir(p) {
+			paths = append(paths, filepath.Join(dir, filepath.FromSlash(p), file))
+			if p == "/" || p == "." {
+				break
+			}
+		}
+	}
+	add(CGROUP_ROOT, v2, "memory.max")
+	add(filepath.Join(CGROUP_ROOT, "memory"), v1, "memory.limit_in_bytes")
+	return paths
+}
+
+// totalMemory returns the memory available to us, which is the memory of
+// the instance or the lowest cgroup limit if that's lower.
+func totalMemory() (int64, error) {
+	f, err := os.Open(MEMINFO_PATH)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	total, err := parseMeminfo(f)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range cgroupLimitPaths() {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		limit := parseCgroupLimit(string(data))
+		if limit > 0 && limit < total {
+			total = limit
+		}
+	}
+	return total, nil
+}
+
+// heapSize leaves the headroom out of the total memory and rounds down
+// to MiB. A negative headroom means the default.
+func heapSize(total, headroom int64) int64 {
+	if headroom < 0 {
+		headroom = int64(float64(total) * MEMORY_HEADROOM_RATIO)
+		if headroom < MEMORY_HEADROOM_MIN {
+			headroom = MEMORY_HEADROOM_MIN
+		}
+	}
+	heap := total - headroom
+	if heap < HEAP_MIN {
+		heap = HEAP_MIN
+	}
+	return heap / (1024 * 1024) * (1024 * 1024)
+}
+
+// memoryArgs() returns the heap and GC flags for the JVM, which are put
+// before SPOTMC_JAVA_ARGS so that flags given there take precedence.
+func (smc *SpotMC) memoryArgs() ([]string, error) {
+	if smc.javaMemory != "auto" && smc.gcPreset == "none" {
+		return nil, nil
+	}
+
+	total, err := totalMemory()
+	if err != nil {
+		return nil, err
+	}
+	heap := heapSize(total, smc.memoryHeadroom)
+
+	var args []string
+	if smc.javaMemory == "auto" {
+		args = append(args,
+			fmt.Sprintf("-Xms%dM", heap/(1024*1024)),
+			fmt.Sprintf("-Xmx%dM", heap/(1024*1024)))
+	}
+	args = append(args, gcPresets[smc.gcPreset](heap)...)
+
+	log.WithFields(log.Fields{
+		"totalMemory": total, "heap": heap, "gcPreset": smc.gcPreset, "args": args,
+	}).Info("JVM memory configured")
+	return args, nil
+}
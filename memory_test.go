@@ -0,0 +1,109 @@
+package spotmc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMeminfo(t *testing.T) {
+	meminfo := `MemTotal:        3915732 kB
+MemFree:          175328 kB
+MemAvailable:    2915512 kB
+`
+	n, err := parseMeminfo(strings.NewReader(meminfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3915732*1024 {
+		t.Errorf("got %d", n)
+	}
+
+	_, err = parseMeminfo(strings.NewReader("MemFree: 1 kB\n"))
+	if err == nil {
+		t.Error("expected an error without MemTotal")
+	}
+}
+
+func TestParseCgroupLimit(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"max\n":                 0,
+		"2147483648\n":          2147483648,
+		"9223372036854771712\n": 0, // cgroup v1 unlimited
+		"garbage":               0,
+	} {
+		if n := parseCgroupLimit(s); n != expected {
+			t.Errorf("%q: got %d, expected %d", s, n, expected)
+		}
+	}
+}
+
+func TestParseProcCgroup(t *testing.T) {
+	v2, v1, err := parseProcCgroup(strings.NewReader("0::/system.slice/spotmc.service\n"))
+	if err != nil || v2 != "/system.slice/spotmc.service" || v1 != "" {
+		t.Errorf("cgroup v2: got %q, %q, %v", v2, v1, err)
+	}
+	v2, v1, err = parseProcCgroup(strings.NewReader(`12:cpu,cpuacct:/system.slice/spotmc.service
+4:memory:/system.slice/spotmc.service
+1:name=systemd:/system.slice/spotmc.service
+`))
+	if err != nil || v2 != "" || v1 != "/system.slice/spotmc.service" {
+		t.Errorf("cgroup v1: got %q, %q, %v", v2, v1, err)
+	}
+}
+
+func TestTotalMemoryCgroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origMeminfo, origProc, origRoot := MEMINFO_PATH, PROC_CGROUP_PATH, CGROUP_ROOT
+	defer func() { MEMINFO_PATH, PROC_CGROUP_PATH, CGROUP_ROOT = origMeminfo, origProc, origRoot }()
+	MEMINFO_PATH = filepath.Join(dir, "meminfo")
+	PROC_CGROUP_PATH = filepath.Join(dir, "cgroup")
+	CGROUP_ROOT = filepath.Join(dir, "sys")
+	ioutil.WriteFile(MEMINFO_PATH, []byte("MemTotal: 8388608 kB\n"), 0644)
+	ioutil.WriteFile(PROC_CGROUP_PATH, []byte("0::/system.slice/spotmc.service\n"), 0644)
+	service := filepath.Join(CGROUP_ROOT, "system.slice", "spotmc.service")
+	os.MkdirAll(service, 0755)
+	ioutil.WriteFile(filepath.Join(CGROUP_ROOT, "memory.max"), []byte("max\n"), 0644)
+
+	const gib = 1024 * 1024 * 1024
+	for _, c := range []struct {
+		name        string
+		slice, unit string
+		expected    int64
+	}{
+		{"no limit", "max", "max", 8 * gib},
+		{"service limit", "max", "2147483648", 2 * gib},
+		{"slice limit", "4294967296", "max", 4 * gib},
+		{"lowest limit", "4294967296", "2147483648", 2 * gib},
+	} {
+		ioutil.WriteFile(filepath.Join(CGROUP_ROOT, "system.slice", "memory.max"), []byte(c.slice), 0644)
+		ioutil.WriteFile(filepath.Join(service, "memory.max"), []byte(c.unit), 0644)
+		n, err := totalMemory()
+		if err != nil || n != c.expected {
+			t.Errorf("%s: got %d, %v", c.name, n, err)
+		}
+	}
+}
+
+func TestHeapSize(t *testing.T) {
+	const mib = 1024 * 1024
+	for _, c := range []struct {
+		total, headroom, expected int64
+	}{
+		{4096 * mib, -1, 3072 * mib}, // a quarter
+		{1024 * mib, -1, 512 * mib},  // at least 512MiB headroom
+		{768 * mib, -1, 512 * mib},   // at least 512MiB heap
+		{8192 * mib, 1024 * mib, 7168 * mib},
+		{4096*mib + 12345, 0, 4096 * mib}, // rounded down to MiB
+	} {
+		if n := heapSize(c.total, c.headroom); n != c.expected {
+			t.Errorf("heapSize(%d, %d) = %d, expected %d", c.total, c.headroom, n, c.expected)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package spotmc
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+var NOTIFY_TIMEOUT = 10 * time.Second
+
+// notification is POSTed as JSON to SPOTMC_NOTIFY_URL.
+type notification struct {
+	Event   string                 `json:"event"`
+	Message string                 `json:"message"`
+	World   string                 `json:"world,omitempty"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// notify() logs an event which needs human attention and,
+// if SPOTMC_NOTIFY_URL is set, sends it to the webhook.
+// Failures to notify are logged but never stop spotmc.
+func (smc *SpotMC) notify(event, message string, fields log.Fields) {
+	entry := log.WithFields(fields).WithField("event", event)
+	if smc.world != "" {
+		entry = entry.WithField("world", smc.world)
+	}
+	entry.Warn(message)
+
+	smc.mu.Lock()
+	notifyURL := smc.notifyURL
+	smc.mu.Unlock()
+	if notifyURL == "" {
+		return
+	}
+
+	n := notification{
+		Event:   event,
+		Message: message,
+		World:   smc.world,
+		Fields:  fields,
+		Time:    time.Now(),
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("encoding notification failed")
+		return
+	}
+
+	cli := http.Client{Timeout: NOTIFY_TIMEOUT}
+	resp, err := cli.Post(notifyURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("sending notification failed")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.WithFields(log.Fields{"status": resp.Status}).Error("notification rejected")
+	}
+}
@@ -0,0 +1,450 @@
+package spotmc
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var PLAYERS_SUFFIX = ".players.json"
+var DEFAULT_PROFILE_LOOKUP_URL = "https://api.mojang.com/users/profiles/minecraft/"
+var PROFILE_LOOKUP_TIMEOUT = 10 * time.Second
+var DEFAULT_PLAYERS_SYNC_INTERVAL = 60
+var DEFAULT_OP_LEVEL = 4
+var BAN_TIME_FORMAT = "2006-01-02 15:04:05 -0700"
+var PLAYERS_UPDATE_TRIES = 5
+
+type playerEntry struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+type opEntry struct {
+	UUID                string `json:"uuid"`
+	Name                string `json:"name"`
+	Level               int    `json:"level"`
+	BypassesPlayerLimit bool   `json:"bypassesPlayerLimit"`
+}
+
+type banEntry struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	Created string `json:"created"`
+	Source  string `json:"source"`
+	Expires string `json:"expires"`
+	Reason  string `json:"reason"`
+}
+
+// playerLists is the canonical copy of whitelist.json, ops.json and
+// banned-players.json kept at SPOTMC_PLAYERS_URL.
+type playerLists struct {
+	Whitelist []playerEntry `json:"whitelist"`
+	Ops       []opEntry     `json:"ops"`
+	Banned    []banEntry    `json:"banned"`
+}
+
+// canonicalize sorts the lists by name so that the stored JSON only
+// changes when the lists do.
+func (l *playerLists) canonicalize() {
+	if l.Whitelist == nil {
+		l.Whitelist = []playerEntry{}
+	}
+	if l.Ops == nil {
+		l.Ops = []opEntry{}
+	}
+	if l.Banned == nil {
+		l.Banned = []banEntry{}
+	}
+	sort.Slice(l.Whitelist, func(i, j int) bool {
+		return strings.ToLower(l.Whitelist[i].Name) < strings.ToLower(l.Whitelist[j].Name)
+	})
+	sort.Slice(l.Ops, func(i, j int) bool {
+		return strings.ToLower(l.Ops[i].Name) < strings.ToLower(l.Ops[j].Name)
+	})
+	sort.Slice(l.Banned, func(i, j int) bool {
+		return strings.ToLower(l.Banned[i].Name) < strings.ToLower(l.Banned[j].Name)
+	})
+}
+
+func (l *playerLists) encode() ([]byte, error) {
+	l.canonicalize()
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// commands returns the console commands which turn the lists in old
+// into the ones in l on a running game server.
+func (l *playerLists) commands(old *playerLists) []string {
+	var cmds []string
+	added, removed := diffNames(namesOf(l.Whitelist), namesOf(old.Whitelist))
+	for _, n := range added {
+		cmds = append(cmds, "whitelist add "+n)
+	}
+	for _, n := range removed {
+		cmds = append(cmds, "whitelist remove "+n)
+	}
+
+	var opNames, oldOpNames []string
+	for _, e := range l.Ops {
+		opNames = append(opNames, e.Name)
+	}
+	for _, e := range old.Ops {
+		oldOpNames = append(oldOpNames, e.Name)
+	}
+	added, removed = diffNames(opNames, oldOpNames)
+	for _, n := range added {
+		cmds = append(cmds, "op "+n)
+	}
+	for _, n := range removed {
+		cmds = append(cmds, "deop "+n)
+	}
+
+	var banNames, oldBanNames []string
+	reasons := map[string]string{}
+	for _, e := range l.Banned {
+		banNames = append(banNames, e.Name)
+		reasons[e.Name] = e.Reason
+	}
+	for _, e := range old.Banned {
+		oldBanNames = append(oldBanNames, e.Name)
+	}
+	added, removed = diffNames(banNames, oldBanNames)
+	for _, n := range added {
+		cmds = append(cmds, strings.TrimSpace("ban "+n+" "+reasons[n]))
+	}
+	for _, n := range removed {
+		cmds = append(cmds, "pardon "+n)
+	}
+	return cmds
+}
+
+func namesOf(entries []playerEntry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// diffNames returns the names in a but not in b and vice versa,
+// ignoring case as the game server does.
+func diffNames(a, b []string) (added, removed []string) {
+	inA := map[string]bool{}
+	for _, n := range a {
+		inA[strings.ToLower(n)] = true
+	}
+	inB := map[string]bool{}
+	for _, n := range b {
+		inB[strings.ToLower(n)] = true
+	}
+	for _, n := range a {
+		if !inB[strings.ToLower(n)] {
+			added = append(added, n)
+		}
+	}
+	for _, n := range b {
+		if !inA[strings.ToLower(n)] {
+			removed = append(removed, n)
+		}
+	}
+	return added, removed
+}
+
+// getPlayerLists returns nil if there's no canonical copy yet, along
+// with the ETag of what was read ("" if nothing).
+func getPlayerLists(url string, env *envelope) (*playerLists, string, error) {
+	body, etag, err := S3GetStream(url)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err = env.open(data)
+	if err != nil {
+		return nil, "", err
+	}
+	var l playerLists
+	err = json.Unmarshal(data, &l)
+	if err != nil {
+		return nil, "", err
+	}
+	l.canonicalize()
+	return &l, etag, nil
+}
+
+// updatePlayerLists() applies edit to the canonical player lists.
+// S3 has no conditional put, so like a save of the world data it
+// compares the ETag right before writing, and starts over from a fresh
+// copy if someone else wrote it in the meantime.
+func updatePlayerLists(url string, env *envelope, edit func(l *playerLists) error) error {
+	for i := 0; i < PLAYERS_UPDATE_TRIES; i++ {
+		l, etag, err := getPlayerLists(url, env)
+		if err != nil {
+			return err
+		}
+		if l == nil {
+			l = &playerLists{}
+			l.canonicalize()
+		}
+		err = edit(l)
+		if err != nil {
+			return err
+		}
+
+		remoteETag, err := S3HeadETag(url)
+		if err != nil {
+			return err
+		}
+		if remoteETag != etag {
+			log.WithFields(log.Fields{
+				"url": url, "etag": etag, "remoteETag": remoteETag,
+			}).Warn("player lists were changed by someone else, trying again")
+			continue
+		}
+		return putPlayerLists(url, l, env)
+	}
+	return fmt.Errorf("player lists kept changing, gave up after %d tries", PLAYERS_UPDATE_TRIES)
+}
+
+func putPlayerLists(url string, l *playerLists, env *envelope) error {
+	data, err := l.encode()
+	if err != nil {
+		return err
+	}
+	data, err = env.seal(data)
+	if err != nil {
+		return err
+	}
+	return S3PutBytes(url, data)
+}
+
+// lookupProfile resolves a player name to its UUID, in the dashed form
+// the game server writes.
+func lookupProfile(lookupURL, name string) (playerEntry, error) {
+	cli := http.Client{Timeout: PROFILE_LOOKUP_TIMEOUT}
+	resp, err := cli.Get(lookupURL + url.PathEscape(name))
+	if err != nil {
+		return playerEntry{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 204 || resp.StatusCode == 404 {
+		return playerEntry{}, fmt.Errorf("no such player: %s", name)
+	}
+	if resp.StatusCode != 200 {
+		return playerEntry{}, fmt.Errorf("looking up %s: %s", name, resp.Status)
+	}
+	var profile struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&profile)
+	if err != nil {
+		return playerEntry{}, err
+	}
+	id := strings.Replace(profile.ID, "-", "", -1)
+	if len(id) != 32 {
+		return playerEntry{}, fmt.Errorf("invalid uuid for %s: %q", name, profile.ID)
+	}
+	return playerEntry{
+		UUID: fmt.Sprintf("%s-%s-%s-%s-%s", id[0:8], id[8:12], id[12:16], id[16:20], id[20:32]),
+		Name: profile.Name,
+	}, nil
+}
+
+// writePlayerFiles() replaces the player lists in the data dir with the
+// canonical copy, if there is one.
+func (smc *SpotMC) writePlayerFiles() error {
+	l, _, err := getPlayerLists(smc.playersURL, smc.envelope)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return nil
+	}
+	for file, v := range map[string]interface{}{
+		"whitelist.json":      l.Whitelist,
+		"ops.json":            l.Ops,
+		"banned-players.json": l.Banned,
+	} {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(smc.dataDirPath, file), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	smc.players = l
+	log.WithFields(log.Fields{
+		"whitelist": len(l.Whitelist), "ops": len(l.Ops), "banned": len(l.Banned),
+	}).Info("player lists applied")
+	return nil
+}
+
+// playersWatcher() applies changes of the canonical player lists to the
+// running game server through RCON.
+func (smc *SpotMC) playersWatcher() {
+	d := time.Duration(smc.playersInterval) * time.Second
+	if d <= 0 {
+		return
+	}
+	etag, _ := S3HeadETag(smc.playersURL)
+	for {
+		time.Sleep(d)
+		newETag, err := S3HeadETag(smc.playersURL)
+		if err != nil || newETag == "" || newETag == etag {
+			continue
+		}
+
+		l, _, err := getPlayerLists(smc.playersURL, smc.envelope)
+		if err != nil || l == nil {
+			log.WithFields(log.Fields{"err": err}).Warn("reading player lists failed")
+			continue
+		}
+		old := smc.players
+		if old == nil {
+			old = &playerLists{}
+		}
+		failed := false
+		for _, cmd := range l.commands(old) {
+			out, err := smc.rconCommand(cmd)
+			if err != nil {
+				log.WithFields(log.Fields{"command": cmd, "err": err}).Warn("applying player lists failed")
+				failed = true
+				break
+			}
+			log.WithFields(log.Fields{"command": cmd, "output": out}).Info("player lists updated")
+		}
+		if failed {
+			// Try again next time
+			continue
+		}
+		smc.players = l
+		etag = newETag
+	}
+}
+
+// PlayersCommand implements "spotmc players", which edits the canonical
+// player lists without the game server running.
+func PlayersCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: spotmc players list|add|remove|op|deop|ban|unban [name] [reason]")
+	}
+	smc, err := NewSpotMC()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		l, _, err := getPlayerLists(smc.playersURL, smc.envelope)
+		if err != nil {
+			return err
+		}
+		if l == nil {
+			return nil
+		}
+		for _, e := range l.Whitelist {
+			fmt.Printf("whitelist\t%s\t%s\n", e.Name, e.UUID)
+		}
+		for _, e := range l.Ops {
+			fmt.Printf("op\t%s\t%s\tlevel %d\n", e.Name, e.UUID, e.Level)
+		}
+		for _, e := range l.Banned {
+			fmt.Printf("banned\t%s\t%s\t%s\n", e.Name, e.UUID, e.Reason)
+		}
+		return nil
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("usage: spotmc players %s <name>", args[0])
+	}
+
+	name := args[1]
+	p, err := lookupProfile(smc.profileLookupURL, name)
+	if err != nil {
+		return err
+	}
+	err = updatePlayerLists(smc.playersURL, smc.envelope, func(l *playerLists) error {
+		return editPlayerLists(l, args[0], p, args[2:])
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s %s (%s) done\n", args[0], p.Name, p.UUID)
+	return nil
+}
+
+// editPlayerLists applies a "spotmc players" command on player p to l.
+func editPlayerLists(l *playerLists, command string, p playerEntry, args []string) error {
+	switch command {
+	case "add":
+		l.Whitelist = append(removePlayer(l.Whitelist, p.UUID), p)
+	case "remove":
+		l.Whitelist = removePlayer(l.Whitelist, p.UUID)
+	case "op":
+		l.Ops = append(removeOp(l.Ops, p.UUID), opEntry{UUID: p.UUID, Name: p.Name, Level: DEFAULT_OP_LEVEL})
+	case "deop":
+		l.Ops = removeOp(l.Ops, p.UUID)
+	case "ban":
+		reason := "Banned by an operator."
+		if len(args) > 0 {
+			reason = strings.Join(args, " ")
+		}
+		l.Banned = append(removeBan(l.Banned, p.UUID), banEntry{
+			UUID: p.UUID, Name: p.Name, Created: time.Now().Format(BAN_TIME_FORMAT),
+			Source: "spotmc", Expires: "forever", Reason: reason,
+		})
+	case "unban":
+		l.Banned = removeBan(l.Banned, p.UUID)
+	default:
+		return fmt.Errorf("unknown players command: %s", command)
+	}
+	return nil
+}
+
+func removePlayer(entries []playerEntry, uuid string) []playerEntry {
+	var kept []playerEntry
+	for _, e := range entries {
+		if e.UUID != uuid {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+func removeOp(entries []opEntry, uuid string) []opEntry {
+	var kept []opEntry
+	for _, e := range entries {
+		if e.UUID != uuid {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+func removeBan(entries []banEntry, uuid string) []banEntry {
+	var kept []banEntry
+	for _, e := range entries {
+		if e.UUID != uuid {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
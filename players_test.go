@@ -0,0 +1,120 @@
+package spotmc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlayerListCommands(t *testing.T) {
+	old := &playerLists{
+		Whitelist: []playerEntry{{Name: "Notch"}, {Name: "jeb_"}},
+		Ops:       []opEntry{{Name: "Notch", Level: 4}, {Name: "Dinnerbone", Level: 4}},
+		Banned:    []banEntry{{Name: "Forgiven"}},
+	}
+	l := &playerLists{
+		Whitelist: []playerEntry{{Name: "notch"}, {Name: "Dinnerbone"}},
+		// A level change has no console command
+		Ops:    []opEntry{{Name: "Dinnerbone", Level: 2}},
+		Banned: []banEntry{{Name: "Griefer", Reason: "griefing"}, {Name: "Quiet"}},
+	}
+	expected := []string{
+		"whitelist add Dinnerbone",
+		"whitelist remove jeb_",
+		"deop Notch",
+		"ban Griefer griefing",
+		"ban Quiet",
+		"pardon Forgiven",
+	}
+	if cmds := l.commands(old); !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("got %q, expected %q", cmds, expected)
+	}
+	if cmds := l.commands(l); len(cmds) != 0 {
+		t.Errorf("got %q for no change", cmds)
+	}
+}
+
+func TestLookupProfile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case "notch":
+			w.Write([]byte(`{"id":"069a79f444e94726a5befca90e38aaf5","name":"Notch"}`))
+		case "broken":
+			w.Write([]byte(`{"id":"069a79f4","name":"broken"}`))
+		case "nobody":
+			w.WriteHeader(204)
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer ts.Close()
+	timeout := PROFILE_LOOKUP_TIMEOUT
+	PROFILE_LOOKUP_TIMEOUT = 50 * time.Millisecond
+	defer func() { PROFILE_LOOKUP_TIMEOUT = timeout }()
+
+	p, err := lookupProfile(ts.URL+"/", "notch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := playerEntry{UUID: "069a79f4-44e9-4726-a5be-fca90e38aaf5", Name: "Notch"}
+	if p != expected {
+		t.Errorf("got %v", p)
+	}
+	for _, name := range []string{"broken", "nobody", "error", "slow"} {
+		_, err = lookupProfile(ts.URL+"/", name)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestUpdatePlayerLists(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	url := "s3://bucket/data.tgz.players.json"
+	env := &envelope{}
+	notch := playerEntry{UUID: "069a79f4-44e9-4726-a5be-fca90e38aaf5", Name: "Notch"}
+	jeb := playerEntry{UUID: "853c80ef-3c37-49fd-aa49-938b674adae6", Name: "jeb_"}
+
+	// Another "spotmc players" writes between our read and write
+	tries := 0
+	err := updatePlayerLists(url, env, func(l *playerLists) error {
+		tries++
+		if tries == 1 {
+			other := &playerLists{Whitelist: []playerEntry{jeb}}
+			if err := putPlayerLists(url, other, env); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return editPlayerLists(l, "add", notch, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tries != 2 {
+		t.Errorf("tried %d times", tries)
+	}
+	l, _, err := getPlayerLists(url, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Whitelist) != 2 {
+		t.Errorf("an update was lost: %v", l.Whitelist)
+	}
+
+	// It gives up if the lists keep changing
+	n := 0
+	err = updatePlayerLists(url, env, func(l *playerLists) error {
+		n++
+		fake.put(url, strings.Repeat(" ", n)+"{}")
+		return nil
+	})
+	if err == nil || n != PLAYERS_UPDATE_TRIES {
+		t.Errorf("got %v after %d tries", err, n)
+	}
+}
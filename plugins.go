@@ -0,0 +1,172 @@
+package spotmc
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/goura/spotmc/archiver"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var DEFAULT_PLUGIN_DIR = "plugins"
+
+// Files installed from the plugin manifest, kept in the data dir so that
+// the ones dropped from the manifest can be removed on the next boot
+var PLUGIN_STATE_FILE = ".spotmc-plugins.json"
+
+// pluginManifest is the JSON at SPOTMC_PLUGINS_URL.
+type pluginManifest struct {
+	Plugins []pluginEntry `json:"plugins"`
+}
+
+type pluginEntry struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"` // http(s):// or s3://
+	SHA256 string `json:"sha256"`
+	Dir    string `json:"dir,omitempty"`  // like "plugins" or "mods"
+	File   string `json:"file,omitempty"` // defaults to the last part of the URL
+}
+
+// path returns where the plugin goes, relative to the data dir.
+func (e *pluginEntry) path() string {
+	dir := e.Dir
+	if dir == "" {
+		dir = DEFAULT_PLUGIN_DIR
+	}
+	file := e.File
+	if file == "" {
+		file = path.Base(strings.SplitN(e.URL, "?", 2)[0])
+	}
+	return path.Join(dir, file)
+}
+
+// syncPlugins() makes the plugins in the data dir match the manifest:
+// missing or changed ones are installed, and the ones spotmc installed
+// before but aren't listed anymore are removed. Plugins put into the data
+// dir by hand are left alone.
+// Downloads are cached under SPOTMC_CACHE_URL by their checksum.
+func (smc *SpotMC) syncPlugins() error {
+	if smc.pluginsURL == "" {
+		return nil
+	}
+
+	data, err := readURL(smc.pluginsURL)
+	if err != nil {
+		return err
+	}
+	var m pluginManifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return fmt.Errorf("invalid plugin manifest: %s", err)
+	}
+
+	statePath := filepath.Join(smc.dataDirPath, PLUGIN_STATE_FILE)
+	installed := map[string]string{}
+	data, err = ioutil.ReadFile(statePath)
+	if err == nil {
+		err = json.Unmarshal(data, &installed)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"err": err}).Warn("reading plugin state failed, not removing old plugins")
+		installed = map[string]string{}
+	}
+
+	state := map[string]string{}
+	for _, e := range m.Plugins {
+		p := e.path()
+		if e.SHA256 == "" {
+			return fmt.Errorf("plugin %s has no sha256", e.Name)
+		}
+		if state[p] != "" {
+			return fmt.Errorf("plugin %s: %s is listed twice", e.Name, p)
+		}
+		target, err := archiver.SafeJoin(smc.dataDirPath, p)
+		if err != nil {
+			return err
+		}
+		err = smc.installPlugin(e, target)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %s", e.Name, err)
+		}
+		state[p] = strings.ToLower(e.SHA256)
+	}
+
+	for p := range installed {
+		if state[p] != "" {
+			continue
+		}
+		target, err := archiver.SafeJoin(smc.dataDirPath, p)
+		if err != nil {
+			continue
+		}
+		err = os.Remove(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.WithFields(log.Fields{"path": p}).Info("plugin removed")
+	}
+
+	data, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, data, 0644)
+}
+
+// installPlugin() puts the plugin at target unless it's already there.
+func (smc *SpotMC) installPlugin(e pluginEntry, target string) error {
+	sum, _, err := fileSHA256(target)
+	if err == nil && strings.EqualFold(sum, e.SHA256) {
+		return nil
+	}
+
+	logFields := log.Fields{"name": e.Name, "path": e.path()}
+	cacheURL := smc.cacheURL + "plugins/" + strings.ToLower(e.SHA256)
+	data, err := S3GetBytes(cacheURL)
+	if err == nil && strings.EqualFold(sha256Hex(data), e.SHA256) {
+		log.WithFields(logFields).Info("plugin taken from the cache")
+	} else {
+		data, err = readURL(e.URL)
+		if err != nil {
+			return err
+		}
+		sum := sha256Hex(data)
+		if !strings.EqualFold(sum, e.SHA256) {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", e.SHA256, sum)
+		}
+		err = S3PutBytes(cacheURL, data)
+		if err != nil {
+			log.WithFields(logFields).WithField("err", err).Warn("caching the plugin failed")
+		}
+	}
+
+	// The restored data dir may have a symlink on the way
+	f, err := archiver.OpenFile(smc.dataDirPath, target, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(logFields).Info("plugin installed")
+	return nil
+}
+
+func readURL(url string) ([]byte, error) {
+	r, err := openURL(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,127 @@
+package spotmc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncPlugins(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataDir := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(dataDir, "plugins"), 0755)
+	ioutil.WriteFile(filepath.Join(dataDir, "plugins/hand.jar"), []byte("by hand"), 0644)
+
+	smc := &SpotMC{
+		pluginsURL:  "s3://bucket/plugins.json",
+		cacheURL:    "s3://bucket/.cache/",
+		dataDirPath: dataDir,
+	}
+	fake.put("s3://bucket/src/a.jar", "plugin a")
+	fake.put("s3://bucket/src/b.jar", "plugin b")
+	setManifest := func(entries ...pluginEntry) {
+		data, _ := json.Marshal(pluginManifest{Plugins: entries})
+		fake.put(smc.pluginsURL, string(data))
+	}
+	a := pluginEntry{Name: "a", URL: "s3://bucket/src/a.jar", SHA256: sha256Hex([]byte("plugin a"))}
+	b := pluginEntry{Name: "b", URL: "s3://bucket/src/b.jar", SHA256: sha256Hex([]byte("plugin b")), Dir: "mods"}
+	readPlugin := func(p string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dataDir, p))
+		return string(data)
+	}
+
+	// Install
+	setManifest(a)
+	err = smc.syncPlugins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readPlugin("plugins/a.jar"); got != "plugin a" {
+		t.Errorf("got %q", got)
+	}
+	if fake.get(smc.cacheURL+"plugins/"+a.SHA256) != "plugin a" {
+		t.Error("the plugin wasn't cached")
+	}
+
+	// Cache hit, the source is gone
+	fake.Delete(a.URL)
+	os.Remove(filepath.Join(dataDir, "plugins/a.jar"))
+	err = smc.syncPlugins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readPlugin("plugins/a.jar"); got != "plugin a" {
+		t.Errorf("got %q from the cache", got)
+	}
+
+	// Already installed, nothing is fetched
+	fake.Delete(smc.cacheURL + "plugins/" + a.SHA256)
+	err = smc.syncPlugins()
+	if err != nil {
+		t.Fatal("an installed plugin was fetched again", err)
+	}
+
+	// Dropped from the manifest
+	setManifest(b)
+	err = smc.syncPlugins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "plugins/a.jar")); !os.IsNotExist(err) {
+		t.Error("a dropped plugin wasn't removed")
+	}
+	if got := readPlugin("mods/b.jar"); got != "plugin b" {
+		t.Errorf("got %q", got)
+	}
+	if got := readPlugin("plugins/hand.jar"); got != "by hand" {
+		t.Error("a plugin installed by hand was touched")
+	}
+
+	// A checksum mismatch fails
+	setManifest(pluginEntry{Name: "c", URL: b.URL, SHA256: a.SHA256})
+	if err := smc.syncPlugins(); err == nil {
+		t.Error("expected a checksum error")
+	}
+}
+
+func TestSyncPluginsRefusesSymlinks(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataDir := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+	os.MkdirAll(dataDir, 0755)
+	// As restored from a tampered archive
+	os.Symlink("../outside", filepath.Join(dataDir, "plugins"))
+
+	smc := &SpotMC{
+		pluginsURL:  "s3://bucket/plugins.json",
+		cacheURL:    "s3://bucket/.cache/",
+		dataDirPath: dataDir,
+	}
+	fake.put("s3://bucket/src/a.jar", "plugin a")
+	data, _ := json.Marshal(pluginManifest{Plugins: []pluginEntry{
+		{Name: "a", URL: "s3://bucket/src/a.jar", SHA256: sha256Hex([]byte("plugin a"))},
+	}})
+	fake.put(smc.pluginsURL, string(data))
+
+	err = smc.syncPlugins()
+	if err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside/a.jar")); err == nil {
+		t.Error("the plugin was written outside of the data dir")
+	}
+}
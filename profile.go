@@ -0,0 +1,300 @@
+package spotmc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/goura/spotmc/archiver"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var DEFAULT_GAME = "minecraft"
+var SERVER_PATH_PREFIX = "gameserver"
+
+// gitignore-style patterns in the data dir, added to SPOTMC_ARCHIVE_EXCLUDES
+var ARCHIVE_IGNORE_FILE = ".spotmcignore"
+
+// GameProfile describes how spotmc runs one kind of game server.
+// Most of it can be overridden by env vars, see newSpotMC().
+type GameProfile struct {
+	// Env vars which must be set
+	Required []string
+	// Fetch gets the server binaries, before the data is restored
+	Fetch func(smc *SpotMC) error
+	// Prepare sets up the restored data dir before the server starts
+	Prepare func(smc *SpotMC) error
+	// The default of SPOTMC_SERVER_COMMAND
+	Command string
+	// Added to the environment of the server
+	Env []string
+	// Paths in the data dir which are saved, everything if empty
+	Persist []string
+	// The default of SPOTMC_ARCHIVE_EXCLUDES
+	Excludes []string
+	// Typed into the console to stop the server, SIGTERM if empty
+	StopCommand string
+	// Typed into the console to write the world before a backup
+	SaveCommand string
+	// Snapshot makes the data consistent for a backup while the server
+	// runs. It returns the dir to save and a func to call after saving.
+	// If nil, SaveCommand is typed and the data dir is saved after a while.
+	Snapshot func(smc *SpotMC) (dir string, done func(), err error)
+	// The default of SPOTMC_IDLE_WATCH_PATH, no idle detection if empty
+	IdleWatchPath string
+	// The log line printed once the server accepts players
+	ReadyPattern *regexp.Regexp
+	// The log line printed when the server stops on request. If nil,
+	// exiting with 0 is a clean stop.
+	StopPattern *regexp.Regexp
+	// Players returns how many players are online. If nil, the mtime of
+	// the idle watch path tells whether someone plays.
+	Players func(smc *SpotMC) (int, error)
+	// Watch runs along with the server
+	Watch func(smc *SpotMC)
+	// Whether the server runs on Java, see prepareJava()
+	Java bool
+}
+
+var gameProfiles = map[string]*GameProfile{
+	"minecraft": {
+		Required:      []string{"SPOTMC_SERVER_JAR_URL", "SPOTMC_SERVER_EULA_URL"},
+		Fetch:         fetchMinecraft,
+		Prepare:       prepareMinecraft,
+		Command:       DEFAULT_SERVER_COMMAND,
+		Excludes:      minecraftExcludes,
+		StopCommand:   "stop",
+		Snapshot:      minecraftSnapshot,
+		IdleWatchPath: DEFAULT_IDLE_WATCH_PATH,
+		ReadyPattern:  regexp.MustCompile(`Done \([0-9.,]+s\)!`),
+		StopPattern:   regexp.MustCompile(`Stopping (the )?server`),
+		Watch:         (*SpotMC).playersWatcher,
+		Java:          true,
+	},
+	// Bedrock Dedicated Server. The zip is unpacked into the data dir
+	// as the server expects, and only the worlds and settings are saved.
+	"bedrock": {
+		Required:     []string{"SPOTMC_SERVER_URL"},
+		Fetch:        fetchServerFile,
+		Prepare:      prepareBedrock,
+		Command:      "{{datadir}}/bedrock_server",
+		Env:          []string{"LD_LIBRARY_PATH=."},
+		Persist:      append([]string{"worlds"}, bedrockConfigFiles...),
+		StopCommand:  "stop",
+		Snapshot:     bedrockSnapshot,
+		ReadyPattern: regexp.MustCompile(`Server started\.`),
+		StopPattern:  regexp.MustCompile(`Stopping server`),
+		Players:      bedrockPlayers,
+	},
+	// Any server which is a command and a data dir, like Terraria or
+	// Valheim. SPOTMC_SERVER_URL is unpacked into {{server}} if set.
+	"generic": {
+		Required: []string{"SPOTMC_SERVER_COMMAND"},
+		Fetch:    fetchServerDir,
+		Excludes: archiver.DEFAULT_EXCLUDES,
+	},
+}
+
+// The server jar downloads libraries/ and versions/ again, and Dynmap
+// renders its tiles again
+var minecraftExcludes = append([]string{"/libraries/", "/versions/", "/plugins/dynmap/web/tiles/"}, archiver.DEFAULT_EXCLUDES...)
+
+// Settings in the Bedrock Dedicated Server zip, which a new version
+// mustn't overwrite
+var bedrockConfigFiles = []string{"server.properties", "allowlist.json", "permissions.json"}
+
+// persisted tells whether a slash separated path in the data dir is
+// saved, given the paths to persist (everything if none). The parent dirs
+// of the paths are kept too, so that walking the data dir reaches them.
+func persisted(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, p+"/") || strings.HasPrefix(p, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveFilter returns what tells whether a path in the data dir goes
+// into the saved data: it's persisted, and not excluded by
+// SPOTMC_ARCHIVE_EXCLUDES followed by the patterns in .spotmcignore.
+func (smc *SpotMC) archiveFilter() func(name string, dir bool) bool {
+	patterns := smc.excludes
+	data, err := ioutil.ReadFile(filepath.Join(smc.dataDirPath, ARCHIVE_IGNORE_FILE))
+	if err == nil {
+		patterns = append(append([]string{}, patterns...), strings.Split(string(data), "\n")...)
+	} else if !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"err": err}).Warn("reading " + ARCHIVE_IGNORE_FILE + " failed")
+	}
+	return func(name string, dir bool) bool {
+		return persisted(name, smc.persist) && !archiver.Excluded(name, dir, patterns)
+	}
+}
+
+// fetchMinecraft() gets the server jar and a java runtime to run it.
+func fetchMinecraft(smc *SpotMC) error {
+	log.Info("retrieving game server jar file")
+	_, err := smc.getJarFile()
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"path": smc.serverPath,
+	}).Info("game server jar file retrieved")
+
+	return smc.prepareJava()
+}
+
+// prepareMinecraft() puts the EULA, plugins, server.properties
+// overrides and player lists into the data dir.
+func prepareMinecraft(smc *SpotMC) error {
+	err := smc.writeEULA()
+	if err != nil {
+		return err
+	}
+	err = smc.syncPlugins()
+	if err != nil {
+		return err
+	}
+	err = smc.applyProperties()
+	if err != nil {
+		return err
+	}
+	return smc.writePlayerFiles()
+}
+
+// writeEULA() puts the user-provided eula.txt into a new data dir.
+func (smc *SpotMC) writeEULA() error {
+	eulaFilePath := filepath.Join(smc.dataDirPath, "eula.txt")
+	if _, err := os.Stat(eulaFilePath); err == nil {
+		return nil
+	}
+	log.WithFields(log.Fields{"url": smc.EULAFileURL}).Info("downloading EULA file")
+	err := S3Get(smc.EULAFileURL, eulaFilePath)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("downloading EULA file failed")
+		return err
+	}
+	log.WithFields(log.Fields{"path": eulaFilePath}).Info("EULA file")
+	return nil
+}
+
+// fetchServerFile() downloads SPOTMC_SERVER_URL into a temp dir and
+// checks SPOTMC_SERVER_SHA256 if set.
+func fetchServerFile(smc *SpotMC) error {
+	dir, err := ioutil.TempDir(JAR_PATH_DIR, SERVER_PATH_PREFIX)
+	if err != nil {
+		return err
+	}
+	url := serverDownloadURL(smc.serverURL)
+	file := filepath.Join(dir, path.Base(url))
+	logFields := log.Fields{"url": url, "path": file}
+	log.WithFields(logFields).Info("downloading game server")
+
+	r, err := openURL(url)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if smc.serverSHA256 != "" && sum != smc.serverSHA256 {
+		return fmt.Errorf("game server checksum mismatch: expected %s, got %s", smc.serverSHA256, sum)
+	}
+
+	smc.serverPath = file
+	log.WithFields(logFields).WithField("sha256", sum).Info("game server downloaded")
+	return nil
+}
+
+// fetchServerDir() downloads SPOTMC_SERVER_URL, if set, and unpacks it
+// if it's an archive.
+func fetchServerDir(smc *SpotMC) error {
+	if smc.serverURL == "" {
+		return nil
+	}
+	err := fetchServerFile(smc)
+	if err != nil {
+		return err
+	}
+	file := smc.serverPath
+	if !isServerArchive(file) {
+		return os.Chmod(file, 0755)
+	}
+	dir := filepath.Join(filepath.Dir(file), "server")
+	err = unpackServer(file, dir, nil)
+	if err != nil {
+		return err
+	}
+	os.Remove(file)
+	smc.serverPath = dir
+	return nil
+}
+
+// prepareBedrock() unpacks the server over the data dir, keeping the
+// settings restored from the saved data.
+func prepareBedrock(smc *SpotMC) error {
+	err := unpackServer(smc.serverPath, smc.dataDirPath, func(name string) bool {
+		for _, f := range bedrockConfigFiles {
+			if name == f {
+				_, err := os.Stat(filepath.Join(smc.dataDirPath, f))
+				return err == nil
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"path": smc.dataDirPath}).Info("bedrock server unpacked")
+	return os.Chmod(filepath.Join(smc.dataDirPath, "bedrock_server"), 0755)
+}
+
+func isServerArchive(file string) bool {
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz", ".tar.zst"} {
+		if strings.HasSuffix(file, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// unpackServer extracts a zip or tarball into dir, leaving out the
+// entries skip returns true for.
+func unpackServer(file, dir string, skip func(name string) bool) error {
+	opts := archiver.Options{}
+	if skip != nil {
+		opts.Filter = func(name string, _ bool) bool { return !skip(name) }
+	}
+	if strings.HasSuffix(file, ".zip") {
+		return archiver.ExtractZip(file, dir, opts)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return archiver.Extract(f, dir, opts)
+}
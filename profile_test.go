@@ -0,0 +1,106 @@
+package spotmc
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/goura/spotmc/archiver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersisted(t *testing.T) {
+	paths := []string{"worlds", "server.properties", "config/game"}
+	for name, expected := range map[string]bool{
+		"worlds":                  true,
+		"worlds/Bedrock level/db": true,
+		"server.properties":       true,
+		"config":                  true,
+		"config/game/a.cfg":       true,
+		"config/other.cfg":        false,
+		"bedrock_server":          false,
+		"worlds.bak":              false,
+	} {
+		if got := persisted(name, paths); got != expected {
+			t.Errorf("%s: got %v, expected %v", name, got, expected)
+		}
+	}
+	if !persisted("anything", nil) {
+		t.Error("everything is persisted without paths")
+	}
+
+	// Only the persisted files are archived, less the excludes
+	dataDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	os.MkdirAll(dataDir+"/worlds/level", 0755)
+	ioutil.WriteFile(dataDir+"/worlds/level/level.dat", []byte("level"), 0644)
+	ioutil.WriteFile(dataDir+"/bedrock_server", []byte("binary"), 0755)
+	os.MkdirAll(dataDir+"/worlds/logs", 0755)
+	ioutil.WriteFile(dataDir+"/worlds/logs/latest.log", []byte("log"), 0644)
+	smc := &SpotMC{persist: paths, excludes: []string{"logs/"}, dataDirPath: dataDir}
+	var buf bytes.Buffer
+	files, err := archiver.Write(&buf, dataDir, archiver.Options{Compression: "none", Level: -1, Filter: smc.archiveFilter()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["worlds/level/level.dat"] == "" {
+		t.Errorf("got %v", files)
+	}
+}
+
+func TestUnpackServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataDir := filepath.Join(dir, "data")
+	os.MkdirAll(dataDir, 0755)
+	ioutil.WriteFile(filepath.Join(dataDir, "server.properties"), []byte("server-name=mine"), 0644)
+	skip := func(name string) bool { return name == "server.properties" }
+
+	zipPath := filepath.Join(dir, "bedrock-server.zip")
+	writeZip(t, zipPath, map[string]string{
+		"bedrock_server":    "binary",
+		"server.properties": "server-name=new",
+		"behavior_packs/":   "",
+	})
+	err = unpackServer(zipPath, dataDir, skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dataDir, "bedrock_server")); string(data) != "binary" {
+		t.Errorf("got %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dataDir, "server.properties")); string(data) != "server-name=mine" {
+		t.Errorf("settings were overwritten: %q", data)
+	}
+	if fi, err := os.Stat(filepath.Join(dataDir, "behavior_packs")); err != nil || !fi.IsDir() {
+		t.Errorf("directory not created: %v", err)
+	}
+}
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,478 @@
+package spotmc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf16"
+)
+
+var PROPERTY_ENV_PREFIX = "SPOTMC_PROPERTY_"
+var DEFAULT_SERVER_PORT = 25565
+var DEFAULT_RCON_PORT = 25575
+
+// Value types of the vanilla server.properties keys. Keys which aren't
+// listed are still set, with a warning, as plugins and forks add their own.
+var propertyTypes = map[string]string{
+	"accepts-transfers":                 "bool",
+	"allow-flight":                      "bool",
+	"allow-nether":                      "bool",
+	"broadcast-console-to-ops":          "bool",
+	"broadcast-rcon-to-ops":             "bool",
+	"difficulty":                        "difficulty",
+	"enable-command-block":              "bool",
+	"enable-jmx-monitoring":             "bool",
+	"enable-query":                      "bool",
+	"enable-rcon":                       "bool",
+	"enable-status":                     "bool",
+	"enforce-secure-profile":            "bool",
+	"enforce-whitelist":                 "bool",
+	"entity-broadcast-range-percentage": "int",
+	"force-gamemode":                    "bool",
+	"function-permission-level":         "int",
+	"gamemode":                          "gamemode",
+	"generate-structures":               "bool",
+	"generator-settings":                "string",
+	"hardcore":                          "bool",
+	"hide-online-players":               "bool",
+	"initial-disabled-packs":            "string",
+	"initial-enabled-packs":             "string",
+	"level-name":                        "string",
+	"level-seed":                        "string",
+	"level-type":                        "string",
+	"log-ips":                           "bool",
+	"max-chained-neighbor-updates":      "int",
+	"max-players":                       "int",
+	"max-tick-time":                     "int",
+	"max-world-size":                    "int",
+	"motd":                              "string",
+	"network-compression-threshold":     "int",
+	"online-mode":                       "bool",
+	"op-permission-level":               "int",
+	"player-idle-timeout":               "int",
+	"prevent-proxy-connections":         "bool",
+	"pvp":                               "bool",
+	"query.port":                        "int",
+	"rate-limit":                        "int",
+	"rcon.password":                     "string",
+	"rcon.port":                         "int",
+	"region-file-compression":           "string",
+	"require-resource-pack":             "bool",
+	"resource-pack":                     "string",
+	"resource-pack-id":                  "string",
+	"resource-pack-prompt":              "string",
+	"resource-pack-sha1":                "string",
+	"server-ip":                         "string",
+	"server-port":                       "int",
+	"simulation-distance":               "int",
+	"spawn-animals":                     "bool",
+	"spawn-monsters":                    "bool",
+	"spawn-npcs":                        "bool",
+	"spawn-protection":                  "int",
+	"sync-chunk-writes":                 "bool",
+	"text-filtering-config":             "string",
+	"use-native-transport":              "bool",
+	"view-distance":                     "int",
+	"white-list":                        "bool",
+}
+
+var propertyEnums = map[string][]string{
+	"difficulty": {"peaceful", "easy", "normal", "hard", "0", "1", "2", "3"},
+	"gamemode":   {"survival", "creative", "adventure", "spectator", "0", "1", "2", "3"},
+}
+
+// validateProperty checks a value against the type of a known key.
+func validateProperty(key, value string) error {
+	typ, ok := propertyTypes[key]
+	if !ok {
+		return nil
+	}
+	switch typ {
+	case "bool":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%s must be true or false: %q", key, value)
+		}
+	case "int":
+		_, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number: %q", key, value)
+		}
+	case "string":
+	default:
+		for _, v := range propertyEnums[typ] {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %s: %q", key, strings.Join(propertyEnums[typ], ", "), value)
+	}
+	return nil
+}
+
+// propertyKeyFromEnv maps the env var suffix to a key: "MAX_PLAYERS" is
+// "max-players", and a double underscore is a dot, "QUERY__PORT" is "query.port".
+func propertyKeyFromEnv(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "__", ".", -1)
+	return strings.Replace(s, "_", "-", -1)
+}
+
+// propertyOverrides collects the SPOTMC_PROPERTY_* variables.
+func propertyOverrides(environ []string) map[string]string {
+	overrides := map[string]string{}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, PROPERTY_ENV_PREFIX) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, PROPERTY_ENV_PREFIX)
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			continue
+		}
+		overrides[propertyKeyFromEnv(kv[:i])] = kv[i+1:]
+	}
+	return overrides
+}
+
+// properties is a server.properties file which can be written back
+// with its comments and order kept.
+type properties struct {
+	lines []string       // a line continued with "\" keeps its line breaks
+	keys  map[string]int // line of each key
+	vals  map[string]string
+}
+
+func parseProperties(r io.Reader) (*properties, error) {
+	p := &properties{keys: map[string]int{}, vals: map[string]string{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " \t\f")
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == '!' {
+			p.lines = append(p.lines, line)
+			continue
+		}
+		// An odd number of backslashes at the end joins the next line,
+		// without its leading blanks
+		raw := line
+		for continued(trimmed) && scanner.Scan() {
+			next := scanner.Text()
+			raw += "\n" + next
+			trimmed = trimmed[:len(trimmed)-1] + strings.TrimLeft(next, " \t\f")
+		}
+		p.lines = append(p.lines, raw)
+		key, value := splitProperty(trimmed)
+		p.keys[key] = len(p.lines) - 1
+		p.vals[key] = value
+	}
+	return p, scanner.Err()
+}
+
+func continued(line string) bool {
+	n := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// splitProperty splits "key=value", "key: value" or "key value"
+// and unescapes both sides.
+func splitProperty(line string) (string, string) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' {
+			i++
+			continue
+		}
+		if c == '=' || c == ':' || c == ' ' || c == '\t' {
+			end = i
+			break
+		}
+	}
+	key := line[:end]
+	rest := strings.TrimLeft(line[end:], " \t\f")
+	if strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, ":") {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	return unescapeProperty(key), unescapeProperty(rest)
+}
+
+func unescapeProperty(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i == len(s)-1 {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+4 < len(s) {
+				n, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+				if err == nil {
+					r := rune(n)
+					i += 4
+					// A surrogate pair is two escapes
+					if utf16.IsSurrogate(r) && i+6 < len(s) && s[i+1:i+3] == "\\u" {
+						n2, err := strconv.ParseUint(s[i+3:i+7], 16, 16)
+						if err == nil {
+							r = utf16.DecodeRune(r, rune(n2))
+							i += 6
+						}
+					}
+					b.WriteRune(r)
+					continue
+				}
+			}
+			b.WriteByte('u')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// escapeProperty escapes a value the way Java writes properties,
+// with non-ASCII characters as \uXXXX so any server version reads them.
+func escapeProperty(s string) string {
+	var b strings.Builder
+	if strings.HasPrefix(s, " ") {
+		// Leading blanks would be taken as the separator
+		b.WriteByte('\\')
+	}
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == ':' || r == '=' || r == '#' || r == '!':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("\\t")
+		case r == '\n':
+			b.WriteString("\\n")
+		case r == '\r':
+			b.WriteString("\\r")
+		case r == '\f':
+			b.WriteString("\\f")
+		case r < 0x20 || r > 0x7e:
+			if r > 0xffff {
+				// Surrogate pair
+				r -= 0x10000
+				fmt.Fprintf(&b, "\\u%04x\\u%04x", 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+			} else {
+				fmt.Fprintf(&b, "\\u%04x", r)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (p *properties) Get(key string) (string, bool) {
+	v, ok := p.vals[key]
+	return v, ok
+}
+
+// Set replaces the line of the key, or appends one.
+func (p *properties) Set(key, value string) {
+	line := escapeProperty(key) + "=" + escapeProperty(value)
+	if i, ok := p.keys[key]; ok {
+		p.lines[i] = line
+	} else {
+		p.lines = append(p.lines, line)
+		p.keys[key] = len(p.lines) - 1
+	}
+	p.vals[key] = value
+}
+
+// Delete removes the line of the key.
+func (p *properties) Delete(key string) {
+	i, ok := p.keys[key]
+	if !ok {
+		return
+	}
+	p.lines = append(p.lines[:i], p.lines[i+1:]...)
+	delete(p.keys, key)
+	delete(p.vals, key)
+	for k, j := range p.keys {
+		if j > i {
+			p.keys[k] = j - 1
+		}
+	}
+}
+
+func (p *properties) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, line := range p.lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return buf.WriteTo(w)
+}
+
+// propertyTemplateData is what the override values can refer to,
+// like "Closes at {{.EndTime}}" in the MOTD.
+type propertyTemplateData struct {
+	EndTime string // when the server shuts down for SPOTMC_MAX_UPTIME
+	Version string // the server jar
+}
+
+// enforcedProperties returns the keys spotmc relies on.
+func (smc *SpotMC) enforcedProperties() map[string]string {
+	return map[string]string{
+		"server-port":   strconv.Itoa(smc.serverPort),
+		"enable-query":  "true",
+		"query.port":    strconv.Itoa(smc.serverPort),
+		"enable-rcon":   "true",
+		"rcon.port":     strconv.Itoa(smc.rconPort),
+		"rcon.password": smc.rconPassword,
+	}
+}
+
+// applyProperties() applies the SPOTMC_PROPERTY_* overrides and the keys
+// spotmc relies on to server.properties in the data dir.
+// Invalid values are reported and skipped, the game server would
+// ignore them anyway.
+func (smc *SpotMC) applyProperties() error {
+	if smc.rconPassword == "" {
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		if err != nil {
+			return err
+		}
+		smc.rconPassword = hex.EncodeToString(b)
+	}
+
+	path := filepath.Join(smc.dataDirPath, "server.properties")
+	p := &properties{keys: map[string]int{}, vals: map[string]string{}}
+	f, err := os.Open(path)
+	if err == nil {
+		p, err = parseProperties(f)
+		f.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	data := propertyTemplateData{
+		EndTime: time.Now().Add(time.Duration(smc.maxUptime) * time.Second).Format("15:04 MST"),
+		Version: smc.serverVersion(),
+	}
+	enforced := smc.enforcedProperties()
+
+	keys := make([]string, 0, len(smc.propertyOverrides))
+	for k := range smc.propertyOverrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := expandPropertyTemplate(smc.propertyOverrides[key], data)
+		if err == nil {
+			err = validateProperty(key, value)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"key": key, "err": err}).Error("invalid server property, skipped")
+			continue
+		}
+		if _, ok := enforced[key]; ok {
+			log.WithFields(log.Fields{"key": key}).Warn("server property is managed by spotmc, override ignored")
+			continue
+		}
+		if _, ok := propertyTypes[key]; !ok {
+			log.WithFields(log.Fields{"key": key}).Warn("unknown server property, set anyway")
+		}
+		p.Set(key, value)
+	}
+	enforcedKeys := make([]string, 0, len(enforced))
+	for k := range enforced {
+		enforcedKeys = append(enforcedKeys, k)
+	}
+	sort.Strings(enforcedKeys)
+	for _, key := range enforcedKeys {
+		p.Set(key, enforced[key])
+	}
+
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"overrides": len(keys)}).Info("server.properties updated")
+	return nil
+}
+
+// setRconPassword() puts rcon.password back into server.properties for
+// the game server to read at launch, or with set false removes it again
+// once the game server has read it, so that it's never saved with the data.
+// Only the password spotmc manages is touched.
+func (smc *SpotMC) setRconPassword(set bool) error {
+	if smc.rconPassword == "" {
+		return nil
+	}
+	path := filepath.Join(smc.dataDirPath, "server.properties")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p, err := parseProperties(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	v, ok := p.Get("rcon.password")
+	switch {
+	case set && !ok && p.vals["enable-rcon"] == "true":
+		p.Set("rcon.password", smc.rconPassword)
+	case !set && ok && v == smc.rconPassword:
+		p.Delete("rcon.password")
+	default:
+		return nil
+	}
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func expandPropertyTemplate(s string, data propertyTemplateData) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("property").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	return buf.String(), err
+}
@@ -0,0 +1,180 @@
+package spotmc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProperties(t *testing.T) {
+	input := `#Minecraft server properties
+#Sat Jan 20 12:00:00 UTC 2024
+difficulty=easy
+motd=A Minecraft Server\: été 😀
+max-players=20
+server-port = 25565
+`
+	p, err := parseProperties(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"difficulty":  "easy",
+		"motd":        "A Minecraft Server: été 😀",
+		"max-players": "20",
+		"server-port": "25565",
+	} {
+		if v, _ := p.Get(key); v != expected {
+			t.Errorf("%s: got %q, expected %q", key, v, expected)
+		}
+	}
+
+	// Unchanged lines, comments and order are kept
+	p.Set("max-players", "8")
+	p.Set("motd", "Closes at 23:00 UTC")
+	p.Set("view-distance", "8")
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	expected := `#Minecraft server properties
+#Sat Jan 20 12:00:00 UTC 2024
+difficulty=easy
+motd=Closes at 23\:00 UTC
+max-players=8
+server-port = 25565
+view-distance=8
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+
+	// Written values read back the same
+	for _, v := range []string{" leading space", "a=b:c#d!e\\f", "été 😀", "tab\there"} {
+		p.Set("motd", v)
+		buf.Reset()
+		p.WriteTo(&buf)
+		p2, err := parseProperties(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := p2.Get("motd"); got != v {
+			t.Errorf("got %q, expected %q", got, v)
+		}
+	}
+}
+
+func TestPropertiesContinuation(t *testing.T) {
+	input := `motd=first \
+    second
+generator-settings={"a": 1,\
+  "b": 2}
+level-name=C:\\
+max-players=20
+`
+	p, err := parseProperties(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"motd":               "first second",
+		"generator-settings": `{"a": 1,"b": 2}`,
+		"level-name":         `C:\`, // an escaped backslash doesn't continue
+		"max-players":        "20",
+	} {
+		if v, _ := p.Get(key); v != expected {
+			t.Errorf("%s: got %q, expected %q", key, v, expected)
+		}
+	}
+
+	// Set replaces all the lines of a continued value
+	p.Set("motd", "hi")
+	p.Delete("generator-settings")
+	p.Set("max-players", "8")
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	expected := `motd=hi
+level-name=C:\\
+max-players=8
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestSetRconPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "server.properties")
+	smc := &SpotMC{dataDirPath: dir, rconPassword: "secret"}
+	read := func() string {
+		data, _ := ioutil.ReadFile(path)
+		return string(data)
+	}
+
+	ioutil.WriteFile(path, []byte("enable-rcon=true\nrcon.password=secret\nmotd=hi\n"), 0644)
+	err = smc.setRconPassword(false)
+	if err != nil || read() != "enable-rcon=true\nmotd=hi\n" {
+		t.Errorf("removing: got %q, %v", read(), err)
+	}
+	// A restart of the game server reads it again
+	err = smc.setRconPassword(true)
+	if err != nil || read() != "enable-rcon=true\nmotd=hi\nrcon.password=secret\n" {
+		t.Errorf("restoring: got %q, %v", read(), err)
+	}
+
+	// A password spotmc doesn't manage is left alone
+	ioutil.WriteFile(path, []byte("rcon.password=other\n"), 0644)
+	smc.setRconPassword(false)
+	if read() != "rcon.password=other\n" {
+		t.Errorf("got %q", read())
+	}
+}
+
+func TestPropertyOverrides(t *testing.T) {
+	overrides := propertyOverrides([]string{
+		"SPOTMC_PROPERTY_MAX_PLAYERS=8",
+		"SPOTMC_PROPERTY_QUERY__PORT=25566",
+		"SPOTMC_PROPERTY_MOTD=Closes at {{.EndTime}}",
+		"SPOTMC_DATA_URL=s3://bucket/data.tgz",
+	})
+	expected := map[string]string{
+		"max-players": "8",
+		"query.port":  "25566",
+		"motd":        "Closes at {{.EndTime}}",
+	}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("got %v, expected %v", overrides, expected)
+	}
+
+	v, err := expandPropertyTemplate(overrides["motd"], propertyTemplateData{EndTime: "23:00 UTC"})
+	if err != nil || v != "Closes at 23:00 UTC" {
+		t.Errorf("got %q, %v", v, err)
+	}
+	_, err = expandPropertyTemplate("{{.Unknown}}", propertyTemplateData{})
+	if err == nil {
+		t.Error("expected an error for an unknown template variable")
+	}
+
+	for _, c := range []struct {
+		key, value string
+		valid      bool
+	}{
+		{"max-players", "8", true},
+		{"max-players", "eight", false},
+		{"pvp", "yes", false},
+		{"difficulty", "hard", true},
+		{"difficulty", "nightmare", false},
+		{"some-plugin-key", "anything", true},
+	} {
+		err := validateProperty(c.key, c.value)
+		if (err == nil) != c.valid {
+			t.Errorf("%s=%s: got %v", c.key, c.value, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package spotmc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var RCON_TIMEOUT = 10 * time.Second
+
+// RCON packet types
+const (
+	rconResponse = 0
+	rconCommand  = 2
+	rconLogin    = 3
+)
+
+// Responses are at most 4096 bytes of body in practice
+const rconMaxPacket = 4096 + 14
+
+// rconClient talks the Source RCON protocol the game server speaks.
+type rconClient struct {
+	conn net.Conn
+	id   int32
+}
+
+// dialRCON connects and logs in.
+func dialRCON(addr, password string) (*rconClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, RCON_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	c := &rconClient{conn: conn}
+	id, _, err := c.roundTrip(rconLogin, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if id == -1 {
+		conn.Close()
+		return nil, fmt.Errorf("rcon login failed")
+	}
+	return c, nil
+}
+
+// Command runs a console command and returns its output.
+func (c *rconClient) Command(command string) (string, error) {
+	_, body, err := c.roundTrip(rconCommand, command)
+	return body, err
+}
+
+func (c *rconClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rconClient) roundTrip(typ int32, body string) (int32, string, error) {
+	c.id++
+	c.conn.SetDeadline(time.Now().Add(RCON_TIMEOUT))
+	err := writeRCONPacket(c.conn, c.id, typ, body)
+	if err != nil {
+		return 0, "", err
+	}
+	for {
+		id, respType, resp, err := readRCONPacket(c.conn)
+		if err != nil {
+			return 0, "", err
+		}
+		// The server answers a login with an empty response first
+		if typ == rconLogin && respType == rconResponse && id != -1 {
+			continue
+		}
+		if id != c.id && id != -1 {
+			return 0, "", fmt.Errorf("rcon response to request %d, expected %d", id, c.id)
+		}
+		return id, resp, nil
+	}
+}
+
+func writeRCONPacket(w io.Writer, id, typ int32, body string) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, int32(len(body)+10))
+	binary.Write(&buf, binary.LittleEndian, id)
+	binary.Write(&buf, binary.LittleEndian, typ)
+	buf.WriteString(body)
+	buf.Write([]byte{0, 0})
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func readRCONPacket(r io.Reader) (id, typ int32, body string, err error) {
+	var size int32
+	err = binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if size < 10 || size > rconMaxPacket {
+		return 0, 0, "", fmt.Errorf("invalid rcon packet size: %d", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	id = int32(binary.LittleEndian.Uint32(data[0:4]))
+	typ = int32(binary.LittleEndian.Uint32(data[4:8]))
+	return id, typ, string(bytes.TrimRight(data[8:], "\x00")), nil
+}
+
+// rconCommand() runs a command on the running game server.
+func (smc *SpotMC) rconCommand(command string) (string, error) {
+	c, err := dialRCON(net.JoinHostPort("127.0.0.1", strconv.Itoa(smc.rconPort)), smc.rconPassword)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	return c.Command(command)
+}
@@ -0,0 +1,65 @@
+package spotmc
+
+import (
+	"net"
+	"testing"
+)
+
+// fakeRCONServer answers like the game server: an auth response to the
+// login, and "ran <command>" to commands.
+func fakeRCONServer(t *testing.T, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			id, typ, body, err := readRCONPacket(conn)
+			if err != nil {
+				return
+			}
+			switch typ {
+			case rconLogin:
+				if body != password {
+					id = -1
+				}
+				writeRCONPacket(conn, id, rconCommand, "")
+			case rconCommand:
+				writeRCONPacket(conn, id, rconResponse, "ran "+body)
+			}
+		}
+	}()
+	return l
+}
+
+func TestRCON(t *testing.T) {
+	l := fakeRCONServer(t, "secret")
+	defer l.Close()
+
+	c, err := dialRCON(l.Addr().String(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, cmd := range []string{"whitelist add Notch", "save-all"} {
+		out, err := c.Command(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != "ran "+cmd {
+			t.Errorf("got %q", out)
+		}
+	}
+
+	l2 := fakeRCONServer(t, "secret")
+	defer l2.Close()
+	_, err = dialRCON(l2.Addr().String(), "wrong")
+	if err == nil {
+		t.Error("expected a login failure")
+	}
+}
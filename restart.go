@@ -0,0 +1,299 @@
+package spotmc
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var DEFAULT_MAX_RESTARTS = 3
+var DEFAULT_RESTART_WINDOW = 3600
+var DEFAULT_RESTART_BACKOFF = 10
+var DEFAULT_CRASH_LOG_LINES = 200
+var CRASH_SUFFIX = ".crashes/"
+var RESTART_BACKOFF_MAX = 5 * time.Minute
+
+// Where the game server saved a crash report
+var crashReportLogPattern = regexp.MustCompile(`crash report has been saved to: (.+)$`)
+
+// logTail keeps the last lines the game server printed, and watches them
+// for a clean stop, crash reports and the line telling it's ready.
+type logTail struct {
+	mu          sync.Mutex
+	max         int
+	lines       []string
+	partial     []byte
+	stop        *regexp.Regexp
+	stopLogged  bool
+	crashReport string
+	ready       *regexp.Regexp
+	onReady     func()
+	watchers    []*lineWatcher
+}
+
+// lineWatcher waits for a line of the game server output, see watch().
+type lineWatcher struct {
+	match func(line string) bool
+	ch    chan string
+}
+
+func newLogTail(max int) *logTail {
+	return &logTail{max: max}
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := strings.IndexByte(string(t.partial), '\n')
+		if i < 0 {
+			break
+		}
+		t.add(strings.TrimRight(string(t.partial[:i]), "\r"))
+		t.partial = t.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (t *logTail) add(line string) {
+	if t.stop != nil && t.stop.MatchString(line) {
+		t.stopLogged = true
+	}
+	if m := crashReportLogPattern.FindStringSubmatch(line); m != nil {
+		t.crashReport = strings.TrimSpace(m[1])
+	}
+	kept := t.watchers[:0]
+	for _, w := range t.watchers {
+		if w.match(line) {
+			w.ch <- line
+		} else {
+			kept = append(kept, w)
+		}
+	}
+	t.watchers = kept
+	if t.ready != nil && t.ready.MatchString(line) {
+		// Only the first time
+		t.ready = nil
+		if t.onReady != nil {
+			go t.onReady()
+		}
+	}
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// watch returns a channel which gets the first line match returns true
+// for, and a func to stop watching. match is called with t.mu held.
+func (t *logTail) watch(match func(line string) bool) (<-chan string, func()) {
+	w := &lineWatcher{match: match, ch: make(chan string, 1)}
+	t.mu.Lock()
+	t.watchers = append(t.watchers, w)
+	t.mu.Unlock()
+	return w.ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for i, x := range t.watchers {
+			if x == w {
+				t.watchers = append(t.watchers[:i], t.watchers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (t *logTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n") + "\n"
+}
+
+// serverExit tells how the game server process ended.
+type serverExit struct {
+	startedAt   time.Time
+	err         error
+	success     bool
+	stopChecked bool
+	stopLogged  bool
+	crashReport string
+	log         *logTail
+}
+
+// crashed() is true unless the game server exited with 0, after logging
+// that it's stopping if the game has a stop pattern (as Minecraft does
+// on the "stop" command).
+func (e *serverExit) crashed() bool {
+	if !e.stopChecked {
+		return !e.success
+	}
+	return !(e.success && e.stopLogged)
+}
+
+// launchServer() starts the game server and a goroutine which sends
+// msgGameServerDown with smc.lastExit set when it exits.
+func (smc *SpotMC) launchServer() error {
+	err := smc.setRconPassword(true)
+	if err != nil {
+		return err
+	}
+	tail := newLogTail(smc.crashLogLines)
+	tail.ready = smc.readyPattern
+	tail.stop = smc.stopPattern
+	tail.onReady = smc.serverReady
+	cmd, err := smc.startServer(tail)
+	if err != nil {
+		return err
+	}
+	smc.mu.Lock()
+	smc.tail = tail
+	smc.mu.Unlock()
+	startedAt := time.Now()
+	atomic.StoreInt32(&smc.serverPid, int32(cmd.Process.Pid))
+	atomic.StoreInt32(&smc.restarting, 0)
+
+	go func() {
+		err := cmd.Wait()
+		atomic.StoreInt32(&smc.serverPid, 0)
+		log.WithFields(log.Fields{"err": err}).Info("game server process exited")
+
+		tail.mu.Lock()
+		smc.lastExit = &serverExit{
+			startedAt:   startedAt,
+			err:         err,
+			success:     cmd.ProcessState != nil && cmd.ProcessState.Success(),
+			stopChecked: tail.stop != nil,
+			stopLogged:  tail.stopLogged,
+			crashReport: tail.crashReport,
+			log:         tail,
+		}
+		tail.mu.Unlock()
+		smc.msgs <- msgGameServerDown
+	}()
+	return nil
+}
+
+// restartBackoff decides whether another restart is allowed given the
+// times of the previous ones, and how long to wait before it. The wait
+// doubles with each restart within the window.
+func restartBackoff(history []time.Time, now time.Time, max int, window, base time.Duration) (time.Duration, bool) {
+	n := 0
+	for _, t := range history {
+		if now.Sub(t) < window {
+			n++
+		}
+	}
+	if n >= max {
+		return 0, false
+	}
+	d := base
+	for i := 0; i < n && d < RESTART_BACKOFF_MAX; i++ {
+		d *= 2
+	}
+	if d > RESTART_BACKOFF_MAX {
+		d = RESTART_BACKOFF_MAX
+	}
+	return d, true
+}
+
+// scheduleRestart() handles a crash of the game server: it uploads the
+// crash report and the log, and restarts the server after a backoff by
+// sending msgRestartServer. It returns false if the restart policy gave
+// up, then the data is saved and the instance is killed as usual.
+func (smc *SpotMC) scheduleRestart() bool {
+	e := smc.lastExit
+	smc.mu.Lock()
+	maxRestarts := smc.maxRestarts
+	window := time.Duration(smc.restartWindow) * time.Second
+	base := time.Duration(smc.restartBackoff) * time.Second
+	smc.mu.Unlock()
+
+	now := time.Now()
+	backoff, ok := restartBackoff(smc.restarts, now, maxRestarts, window, base)
+	fields := log.Fields{
+		"err": fmt.Sprint(e.err), "uptime": now.Sub(e.startedAt).Seconds(),
+		"restarts": len(smc.restarts), "crashURL": smc.crashURL,
+	}
+	if !ok {
+		smc.notify("server-crash", "game server crashed too often, giving up", fields)
+		return false
+	}
+	smc.restarts = append(smc.restarts, now)
+	atomic.StoreInt32(&smc.restarting, 1)
+
+	fields["backoff"] = backoff.Seconds()
+	smc.notify("server-crash", "game server crashed, restarting", fields)
+	go func() {
+		smc.uploadCrash(e)
+		time.Sleep(backoff)
+		smc.msgs <- msgRestartServer
+	}()
+	return true
+}
+
+// uploadCrash() puts the crash report, if the game server wrote one,
+// and the last lines of its log under the crash URL.
+func (smc *SpotMC) uploadCrash(e *serverExit) {
+	prefix := fmt.Sprintf("%s%s/", smc.crashURL, time.Now().UTC().Format("20060102T150405Z"))
+
+	err := S3PutBytes(prefix+"latest.log", []byte(e.log.String()))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("uploading the game server log failed")
+	}
+
+	path := smc.findCrashReport(e)
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = S3PutBytes(prefix+filepath.Base(path), data)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"path": path, "err": err}).Error("uploading the crash report failed")
+		return
+	}
+	log.WithFields(log.Fields{"url": prefix + filepath.Base(path)}).Info("crash report uploaded")
+}
+
+// findCrashReport() returns the crash report the game server logged,
+// or else the newest one written since it started.
+func (smc *SpotMC) findCrashReport(e *serverExit) string {
+	if e.crashReport != "" {
+		path := e.crashReport
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(smc.dataDirPath, path)
+		}
+		return path
+	}
+
+	newest := ""
+	var newestTime time.Time
+	dir := filepath.Join(smc.dataDirPath, "crash-reports")
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && fi.ModTime().After(e.startedAt) && fi.ModTime().After(newestTime) {
+			newest = filepath.Join(dir, fi.Name())
+			newestTime = fi.ModTime()
+		}
+	}
+	return newest
+}
+
+// serverOutput returns where the game server's stdout and stderr go:
+// spotmc's own, the log tail and the console log file if any.
+func serverOutput(tail *logTail, console io.Writer) (stdout, stderr io.Writer) {
+	if console == nil {
+		return io.MultiWriter(os.Stdout, tail), io.MultiWriter(os.Stderr, tail)
+	}
+	return io.MultiWriter(os.Stdout, tail, console), io.MultiWriter(os.Stderr, tail, console)
+}
@@ -0,0 +1,34 @@
+package spotmc
+
+import (
+	"testing"
+)
+
+func TestServerExitCrashed(t *testing.T) {
+	for _, c := range []struct {
+		game     string
+		output   string
+		success  bool
+		expected bool
+	}{
+		{"minecraft", "[Server thread/INFO]: Stopping the server\n", true, false},
+		{"minecraft", "[Server thread/INFO]: Stopping the server\n", false, true},
+		{"minecraft", "Exception in server tick loop\n", true, true},
+		{"bedrock", "[INFO] Stopping server...\nQuit correctly\n", true, false},
+		// Without a stop pattern, exiting with 0 is clean
+		{"generic", "bye\n", true, false},
+		{"generic", "bye\n", false, true},
+	} {
+		tail := newLogTail(10)
+		tail.stop = gameProfiles[c.game].StopPattern
+		tail.Write([]byte(c.output))
+		e := &serverExit{
+			success:     c.success,
+			stopChecked: tail.stop != nil,
+			stopLogged:  tail.stopLogged,
+		}
+		if got := e.crashed(); got != c.expected {
+			t.Errorf("%s %q (success %v): got crashed %v", c.game, c.output, c.success, got)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package spotmc
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Exit codes of Main
+var EXIT_SAVE_FAILED = 1
+var EXIT_ABORTED = 2
+
+var DEFAULT_STOP_TIMEOUT = 60
+
+// How long the game server gets to write the world before a backup
+var BACKUP_SETTLE_TIME = 5 * time.Second
+
+// handleSignals() implements the signals spotmc reacts to:
+//
+//	SIGTERM, SIGINT  stop the game server gracefully and save the data.
+//	                 A second one kills the game server right away (the
+//	                 data is still saved), a third exits without saving.
+//	SIGHUP           reload the configuration
+//	SIGUSR1          back up the data now, keeping the game server running
+func (smc *SpotMC) handleSignals() {
+	sigchan := make(chan os.Signal, 4)
+	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+
+	stops := 0
+	for sig := range sigchan {
+		logFields := log.Fields{"signal": sig}
+		switch sig {
+		case syscall.SIGHUP:
+			log.WithFields(logFields).Info("reloading configuration")
+			go func() {
+				err := smc.reloadConfig()
+				if err != nil {
+					log.WithFields(log.Fields{"err": err}).Error("reloading configuration failed, keeping the current one")
+				}
+			}()
+		case syscall.SIGUSR1:
+			log.WithFields(logFields).Info("backup requested")
+			go smc.backup()
+		default:
+			stops++
+			switch stops {
+			case 1:
+				log.WithFields(logFields).Info("stopping the game server and saving data")
+				go func() {
+					smc.msgs <- msgInstanceTerminating
+				}()
+			case 2:
+				log.WithFields(logFields).Warn("signaled again, killing the game server")
+				smc.killServer()
+			default:
+				log.WithFields(logFields).Error("signaled again, exiting without saving data")
+				os.Exit(EXIT_ABORTED)
+			}
+		}
+	}
+}
+
+// consoleCommand() types a command into the game server console.
+func (smc *SpotMC) consoleCommand(command string) error {
+	smc.mu.Lock()
+	defer smc.mu.Unlock()
+	if smc.console == nil {
+		return fmt.Errorf("game server console is not available")
+	}
+	_, err := fmt.Fprintln(smc.console, command)
+	return err
+}
+
+// expectLine() types a command into the game server console and waits
+// for a line of output match returns true for.
+func (smc *SpotMC) expectLine(command string, match func(line string) bool, timeout time.Duration) (string, error) {
+	smc.mu.Lock()
+	tail := smc.tail
+	smc.mu.Unlock()
+	if tail == nil {
+		return "", fmt.Errorf("game server output is not available")
+	}
+	ch, cancel := tail.watch(match)
+	defer cancel()
+	err := smc.consoleCommand(command)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case line := <-ch:
+		return line, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("no response to %q in %s", command, timeout)
+	}
+}
+
+// stopServer() asks the game server to save the world and stop, by the
+// stop command of the game or SIGTERM, and kills it if it's still running
+// after SPOTMC_STOP_TIMEOUT.
+func (smc *SpotMC) stopServer() {
+	var err error
+	if smc.stopCommand != "" {
+		err = smc.consoleCommand(smc.stopCommand)
+	} else {
+		err = smc.signalServer(syscall.SIGTERM)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("stopping the game server failed, killing it")
+		smc.killServer()
+		return
+	}
+
+	smc.mu.Lock()
+	d := time.Duration(smc.stopTimeout) * time.Second
+	smc.mu.Unlock()
+	log.WithFields(log.Fields{"timeout": d.Seconds()}).Info("waiting for the game server to stop")
+	time.AfterFunc(d, func() {
+		if atomic.LoadInt32(&smc.serverPid) != 0 {
+			log.Warn("game server did not stop in time, killing it")
+			smc.killServer()
+		}
+	})
+}
+
+func (smc *SpotMC) killServer() {
+	err := smc.signalServer(os.Kill)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Debug("killing the game server failed")
+	}
+}
+
+// signalServer() sends sig to the game server process. smc.cmd is
+// replaced when the server is restarted, so it's read under smc.mu.
+func (smc *SpotMC) signalServer(sig os.Signal) error {
+	smc.mu.Lock()
+	defer smc.mu.Unlock()
+	if smc.cmd == nil || smc.cmd.Process == nil {
+		return fmt.Errorf("game server is not running")
+	}
+	return smc.cmd.Process.Signal(sig)
+}
+
+// backup() saves the data dir while the game server keeps running.
+// It's skipped once spotmc is stopping, the final save takes over then.
+func (smc *SpotMC) backup() {
+	smc.saveMu.Lock()
+	defer smc.saveMu.Unlock()
+	if atomic.LoadInt32(&smc.stopping) != 0 {
+		log.Info("stopping, backup skipped")
+		return
+	}
+
+	log.Info("backup to S3 started")
+	err := smc.saveData()
+	if err != nil {
+		smc.notify("backup-failed", "backup failed", log.Fields{"err": err.Error()})
+		return
+	}
+	log.Info("backup to S3 done")
+}
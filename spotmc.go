@@ -1,16 +1,21 @@
 package spotmc
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/pivotal-golang/archiver/compressor"
-	"github.com/pivotal-golang/archiver/extractor"
+	"github.com/goura/spotmc/archiver"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,11 +25,15 @@ var JAR_PATH_PREFIX = "mcjar"
 var DATA_PATH_DIR = ""
 var DATA_PATH_PREFIX = "mcdata"
 var TERMINATION_TIME_URL = "http://169.254.169.254/latest/meta-data/spot/termination-time"
+var TERMINATION_NOTICE_TIME = 2 * time.Minute
+
+var errSaveConflict = errors.New("world data was saved as a conflict snapshot")
 
 const (
 	msgInstanceTerminating = iota
 	msgShutdownCluster
 	msgGameServerDown
+	msgRestartServer
 )
 
 // Defaults
@@ -35,6 +44,11 @@ var DEFAULT_MAX_UPTIME = 43200
 var DEFAULT_MAX_IDLE_TIME = 14400
 var DEFAULT_IDLE_WATCH_PATH = "world/playerdata"
 var DEFAULT_IDLE_WATCH_GRACE_TIME = 600
+var DEFAULT_LOCK_TTL = 300
+var DEFAULT_BACKUP_FORMAT = "tgz"
+var DEFAULT_SNAPSHOT_RETENTION = 5
+var DEFAULT_COMPRESSION = "gzip"
+var DEFAULT_COMPRESSION_LEVEL = -1
 
 type SpotMC struct {
 	JarFileURL         string
@@ -51,20 +65,189 @@ type SpotMC struct {
 	shutdownCommand    string
 	idleWatchGraceTime int
 	idleWatchPath      string
+	lockHolder         string
+	lockTTL            int
+	dataETag           string
+	chunkETag          string
+	notifyURL          string
+	backupFormat       string
+	chunkStoreURL      string
+	snapshotRetention  int
+	compression        string
+	compressionLevel   int
+	envelope           *envelope
+	deadlineMargin     int
+	deadlineFallback   string
+	saveDeadline       time.Time
+	restoredAt         time.Time
+	throughput         float64
+	saveMeasured       bool
+	compressionRatio   float64
+	chunkedCurrent     bool
+	serverName         string
+	profile            *GameProfile
+	game               string
+	serverURL          string
+	serverSHA256       string
+	stopCommand        string
+	readyPattern       *regexp.Regexp
+	stopPattern        *regexp.Regexp
+	persist            []string
+	excludes           []string
+	world              string
+	mojangManifestURL  string
+	paperAPIURL        string
+	cacheURL           string
+	pluginsURL         string
+	propertyOverrides  map[string]string
+	serverPort         int
+	rconPort           int
+	rconPassword       string
+	playersURL         string
+	profileLookupURL   string
+	playersInterval    int
+	players            *playerLists
+	javaRuntimeURL     string
+	javaRuntimeSHA256  string
+	javaCacheDir       string
+	javaMinVersion     int
+	javaArgs           []string
+	serverCommand      []string
+	javaMemory         string
+	memoryHeadroom     int64
+	gcPreset           string
+	stopTimeout        int
+	saveTimeout        int
+	maxRestarts        int
+	restartWindow      int
+	restartBackoff     int
+	crashLogLines      int
+	crashURL           string
+	logDir             string
+	logsURL            string
+	logMaxSize         int
+	logMaxFiles        int
+	logUpload          int
+	sessionID          string
+	consoleLog         io.Writer
+	logsUploaded       map[string]string
+	logUploadMu        sync.Mutex
+	restarts           []time.Time
+	lastExit           *serverExit
+	serverPid          int32
+	stopping           int32
+	restarting         int32
+	cmd                *exec.Cmd
+	tail               *logTail
+	console            io.WriteCloser
+	mu                 sync.Mutex // guards the reloadable settings and the console
+	saveMu             sync.Mutex // one save at a time
 	msgs               chan int
 }
 
 func NewSpotMC() (*SpotMC, error) {
+	return newSpotMC("")
+}
+
+// newSpotMC() reads the config for the world, or the one chosen by
+// SPOTMC_WORLD if world is "".
+func newSpotMC(world string) (*SpotMC, error) {
+	// Values in the config file override the environment
+	err := loadConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	// The kind of game server
+	game := DEFAULT_GAME
+	if s := os.Getenv("SPOTMC_GAME"); s != "" {
+		game = s
+	}
+	profile, ok := gameProfiles[game]
+	if !ok {
+		return nil, fmt.Errorf("unknown game: %s", game)
+	}
+
 	// Check mandatory environment variables
-	for _, k := range []string{
-		"SPOTMC_SERVER_JAR_URL",
-		"SPOTMC_SERVER_EULA_URL",
-		"SPOTMC_DATA_URL",
-		"SPOTMC_JAVA_PATH",
-	} {
+	for _, k := range profile.Required {
 		s := os.Getenv(k)
 		if s == "" {
-			return nil, fmt.Errorf("set valid env vars")
+			return nil, fmt.Errorf("set valid env vars (%s)", k)
+		}
+	}
+	dataFileURL, world, err := worldDataURL(world)
+	if err != nil {
+		return nil, err
+	}
+	if dataFileURL == "" {
+		return nil, fmt.Errorf("set SPOTMC_DATA_URL or SPOTMC_WORLDS_URL")
+	}
+
+	// Where server jars are resolved and cached
+	mojangManifestURL := DEFAULT_MOJANG_MANIFEST_URL
+	if s := os.Getenv("SPOTMC_MOJANG_MANIFEST_URL"); s != "" {
+		mojangManifestURL = s
+	}
+	paperAPIURL := DEFAULT_PAPER_API_URL
+	if s := os.Getenv("SPOTMC_PAPER_API_URL"); s != "" {
+		paperAPIURL = s
+	}
+	cacheURL := sharedURL(dataFileURL) + CACHE_SUFFIX
+	if s := os.Getenv("SPOTMC_CACHE_URL"); s != "" {
+		cacheURL = strings.TrimSuffix(s, "/") + "/"
+	}
+
+	// server.properties
+	serverPort := DEFAULT_SERVER_PORT
+	if s := os.Getenv("SPOTMC_SERVER_PORT"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			serverPort = i
+		}
+	}
+	rconPort := DEFAULT_RCON_PORT
+	if s := os.Getenv("SPOTMC_RCON_PORT"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			rconPort = i
+		}
+	}
+
+	// Player lists
+	playersURL := sharedURL(dataFileURL) + PLAYERS_SUFFIX
+	if s := os.Getenv("SPOTMC_PLAYERS_URL"); s != "" {
+		playersURL = s
+	}
+	profileLookupURL := DEFAULT_PROFILE_LOOKUP_URL
+	if s := os.Getenv("SPOTMC_PROFILE_LOOKUP_URL"); s != "" {
+		profileLookupURL = s
+	}
+	playersInterval := DEFAULT_PLAYERS_SYNC_INTERVAL
+	if s := os.Getenv("SPOTMC_PLAYERS_SYNC_INTERVAL"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			playersInterval = i
+		}
+	}
+
+	// Java runtime, either installed or downloaded
+	javaRuntimeURL := os.Getenv("SPOTMC_JAVA_RUNTIME_URL")
+	javaRuntimeSHA256 := strings.ToLower(os.Getenv("SPOTMC_JAVA_RUNTIME_SHA256"))
+	if profile.Java && javaRuntimeURL == "" && os.Getenv("SPOTMC_JAVA_PATH") == "" {
+		return nil, fmt.Errorf("set valid env vars")
+	}
+	if javaRuntimeURL != "" && len(javaRuntimeSHA256) != 64 {
+		return nil, fmt.Errorf("set SPOTMC_JAVA_RUNTIME_SHA256 to the SHA-256 of the java runtime archive")
+	}
+	javaCacheDir := DEFAULT_JAVA_CACHE_DIR
+	if s := os.Getenv("SPOTMC_JAVA_CACHE_DIR"); s != "" {
+		javaCacheDir = s
+	}
+	javaMinVersion := 0
+	if s := os.Getenv("SPOTMC_JAVA_MIN_VERSION"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			javaMinVersion = i
 		}
 	}
 
@@ -101,7 +284,7 @@ func NewSpotMC() (*SpotMC, error) {
 	}
 
 	// Idle watch path
-	idleWatchPath := DEFAULT_IDLE_WATCH_PATH
+	idleWatchPath := profile.IdleWatchPath
 	s = os.Getenv("SPOTMC_IDLE_WATCH_PATH")
 	if s != "" {
 		idleWatchPath = s
@@ -117,13 +300,305 @@ func NewSpotMC() (*SpotMC, error) {
 		}
 	}
 
+	// Lifetime of the world data lock, extended by heartbeats
+	lockTTL := DEFAULT_LOCK_TTL
+	s = os.Getenv("SPOTMC_LOCK_TTL")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			lockTTL = i
+		}
+	}
+
+	// Backup format
+	// "tgz" or "chunked"
+	backupFormat := DEFAULT_BACKUP_FORMAT
+	s = os.Getenv("SPOTMC_BACKUP_FORMAT")
+	if s != "" {
+		backupFormat = s
+	}
+	if backupFormat != "tgz" && backupFormat != "chunked" {
+		return nil, fmt.Errorf("unknown backup format: %s", backupFormat)
+	}
+	chunkStoreURL := dataFileURL + CHUNK_STORE_SUFFIX
+	s = os.Getenv("SPOTMC_CHUNK_STORE_URL")
+	if s != "" {
+		chunkStoreURL = strings.TrimSuffix(s, "/") + "/"
+	}
+	snapshotRetention := DEFAULT_SNAPSHOT_RETENTION
+	s = os.Getenv("SPOTMC_SNAPSHOT_RETENTION")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			snapshotRetention = i
+		}
+	}
+
+	// Compression of the archive
+	// "zstd", "gzip" or "none"
+	compression := DEFAULT_COMPRESSION
+	s = os.Getenv("SPOTMC_COMPRESSION")
+	if s != "" {
+		compression = s
+	}
+	if compression != "zstd" && compression != "gzip" && compression != "none" {
+		return nil, fmt.Errorf("unknown compression format: %s", compression)
+	}
+	compressionLevel := DEFAULT_COMPRESSION_LEVEL
+	s = os.Getenv("SPOTMC_COMPRESSION_LEVEL")
+	if s != "" {
+		compressionLevel, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("SPOTMC_COMPRESSION_LEVEL: %s", err)
+		}
+	}
+	err = archiver.CheckLevel(compression, compressionLevel)
+	if err != nil {
+		return nil, fmt.Errorf("SPOTMC_COMPRESSION_LEVEL: %s", err)
+	}
+
+	// Client-side encryption
+	// "", "passphrase" or "kms"
+	// Every configured key is kept for decryption so that
+	// snapshots made before a key rotation can be restored.
+	var wrapper keyWrapper
+	wrappers := []keyWrapper{}
+	passphrase := os.Getenv("SPOTMC_ENCRYPTION_PASSPHRASE")
+	if passphrase != "" {
+		wrappers = append(wrappers, newPassphraseKeyWrapper(passphrase))
+	}
+	for _, p := range oldPassphrases(os.Environ()) {
+		wrappers = append(wrappers, newPassphraseKeyWrapper(p))
+	}
+	kmsKeyID := os.Getenv("SPOTMC_KMS_KEY_ID")
+	wrappers = append(wrappers, &kmsKeyWrapper{keyID: kmsKeyID})
+	switch os.Getenv("SPOTMC_ENCRYPTION") {
+	case "":
+	case "passphrase":
+		if passphrase == "" {
+			return nil, fmt.Errorf("set SPOTMC_ENCRYPTION_PASSPHRASE")
+		}
+		wrapper = wrappers[0]
+	case "kms":
+		if kmsKeyID == "" {
+			return nil, fmt.Errorf("set SPOTMC_KMS_KEY_ID")
+		}
+		wrapper = wrappers[len(wrappers)-1]
+	default:
+		return nil, fmt.Errorf("unknown encryption: %s", os.Getenv("SPOTMC_ENCRYPTION"))
+	}
+	env := newEnvelope(wrapper, wrappers)
+	env.allowPlaintext = os.Getenv("SPOTMC_ENCRYPTION_ALLOW_PLAINTEXT") == "true"
+
+	// Saving under a spot termination deadline
+	deadlineMargin := DEFAULT_DEADLINE_MARGIN
+	s = os.Getenv("SPOTMC_DEADLINE_MARGIN")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			deadlineMargin = i
+		}
+	}
+	deadlineFallback := DEFAULT_DEADLINE_FALLBACK
+	s = os.Getenv("SPOTMC_DEADLINE_FALLBACK")
+	if s != "" {
+		deadlineFallback = s
+	}
+	if deadlineFallback != saveIncremental && deadlineFallback != saveFast {
+		return nil, fmt.Errorf("unknown deadline fallback: %s", deadlineFallback)
+	}
+
+	// Server command line
+	javaArgs, err := parseArgList(os.Getenv("SPOTMC_JAVA_ARGS"))
+	if err != nil {
+		return nil, fmt.Errorf("SPOTMC_JAVA_ARGS: %s", err)
+	}
+	serverCommandTemplate := profile.Command
+	s = os.Getenv("SPOTMC_SERVER_COMMAND")
+	if s != "" {
+		serverCommandTemplate = s
+	}
+	serverCommand, err := parseArgList(serverCommandTemplate)
+	if err == nil {
+		// Check the placeholders now rather than when starting the server
+		_, err = expandCommand(serverCommand, (&SpotMC{}).commandValues(nil))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SPOTMC_SERVER_COMMAND: %s", err)
+	}
+
+	// How the game server is stopped, when it's ready and what's saved
+	stopCommand := profile.StopCommand
+	if s, ok := os.LookupEnv("SPOTMC_STOP_COMMAND"); ok {
+		stopCommand = s
+	}
+	readyPattern := profile.ReadyPattern
+	if s := os.Getenv("SPOTMC_READY_PATTERN"); s != "" {
+		readyPattern, err = regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("SPOTMC_READY_PATTERN: %s", err)
+		}
+	}
+	stopPattern := profile.StopPattern
+	if s := os.Getenv("SPOTMC_STOP_PATTERN"); s != "" {
+		stopPattern, err = regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("SPOTMC_STOP_PATTERN: %s", err)
+		}
+	}
+	persist := profile.Persist
+	if s := os.Getenv("SPOTMC_PERSIST_PATHS"); s != "" {
+		persist = nil
+		for _, p := range strings.Split(s, ",") {
+			p = strings.Trim(strings.TrimSpace(p), "/")
+			if p != "" {
+				persist = append(persist, p)
+			}
+		}
+	}
+	// gitignore-style patterns left out of the saved data, even within
+	// the persisted paths. Set but empty to save everything.
+	excludes := profile.Excludes
+	if s, ok := os.LookupEnv("SPOTMC_ARCHIVE_EXCLUDES"); ok {
+		excludes = nil
+		for _, p := range strings.Split(s, ",") {
+			p = strings.TrimSpace(p)
+			if p != "" {
+				excludes = append(excludes, p)
+			}
+		}
+	}
+	serverSHA256 := strings.ToLower(os.Getenv("SPOTMC_SERVER_SHA256"))
+
+	// JVM heap size and GC flags
+	javaMemory := os.Getenv("SPOTMC_JAVA_MEMORY")
+	if javaMemory != "" && javaMemory != "auto" {
+		return nil, fmt.Errorf("unknown java memory mode: %s", javaMemory)
+	}
+	memoryHeadroom := int64(-1)
+	s = os.Getenv("SPOTMC_MEMORY_HEADROOM")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil && i >= 0 {
+			memoryHeadroom = int64(i) * 1024 * 1024
+		}
+	}
+	gcPreset := os.Getenv("SPOTMC_GC_PRESET")
+	if gcPreset == "" {
+		gcPreset = "none"
+	}
+	if gcPresets[gcPreset] == nil {
+		return nil, fmt.Errorf("unknown GC preset: %s", gcPreset)
+	}
+
+	// Seconds the game server gets to stop before it's killed
+	stopTimeout := DEFAULT_STOP_TIMEOUT
+	s = os.Getenv("SPOTMC_STOP_TIMEOUT")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			stopTimeout = i
+		}
+	}
+
+	// Seconds the game server gets to write the world before a backup
+	saveTimeout := DEFAULT_SAVE_TIMEOUT
+	s = os.Getenv("SPOTMC_SAVE_TIMEOUT")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil && i > 0 {
+			saveTimeout = i
+		}
+	}
+
+	// Restart policy on crashes
+	maxRestarts := DEFAULT_MAX_RESTARTS
+	s = os.Getenv("SPOTMC_MAX_RESTARTS")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			maxRestarts = i
+		}
+	}
+	restartWindow := DEFAULT_RESTART_WINDOW
+	s = os.Getenv("SPOTMC_RESTART_WINDOW")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			restartWindow = i
+		}
+	}
+	restartBackoff := DEFAULT_RESTART_BACKOFF
+	s = os.Getenv("SPOTMC_RESTART_BACKOFF")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil {
+			restartBackoff = i
+		}
+	}
+	crashLogLines := DEFAULT_CRASH_LOG_LINES
+	s = os.Getenv("SPOTMC_CRASH_LOG_LINES")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil && i > 0 {
+			crashLogLines = i
+		}
+	}
+	crashURL := dataFileURL + CRASH_SUFFIX
+	s = os.Getenv("SPOTMC_CRASH_URL")
+	if s != "" {
+		crashURL = strings.TrimSuffix(s, "/") + "/"
+	}
+
+	// Where spotmc and the game server console log to, and where the logs
+	// are uploaded. An empty SPOTMC_LOG_DIR leaves them on stdout only.
+	logDir := DEFAULT_LOG_DIR
+	if s, ok := os.LookupEnv("SPOTMC_LOG_DIR"); ok {
+		logDir = s
+	}
+	logsURL := logsURL(dataFileURL)
+	logMaxSize := DEFAULT_LOG_MAX_SIZE
+	s = os.Getenv("SPOTMC_LOG_MAX_SIZE")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil && i > 0 {
+			logMaxSize = i
+		}
+	}
+	logMaxFiles := DEFAULT_LOG_MAX_FILES
+	s = os.Getenv("SPOTMC_LOG_MAX_FILES")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil && i > 0 {
+			logMaxFiles = i
+		}
+	}
+	logUpload := DEFAULT_LOG_UPLOAD_INTERVAL
+	s = os.Getenv("SPOTMC_LOG_UPLOAD_INTERVAL")
+	if s != "" {
+		i, err := strconv.Atoi(s)
+		if err == nil && i >= 0 {
+			logUpload = i
+		}
+	}
+
 	// DDNS Update URL
 	ddnsURL := os.Getenv("SPOTMC_DDNS_UPDATE_URL")
 
 	smc := &SpotMC{
+		profile:            profile,
+		game:               game,
+		serverURL:          os.Getenv("SPOTMC_SERVER_URL"),
+		serverSHA256:       serverSHA256,
+		stopCommand:        stopCommand,
+		readyPattern:       readyPattern,
+		stopPattern:        stopPattern,
+		persist:            persist,
+		excludes:           excludes,
 		JarFileURL:         os.Getenv("SPOTMC_SERVER_JAR_URL"),
 		EULAFileURL:        os.Getenv("SPOTMC_SERVER_EULA_URL"),
-		DataFileURL:        os.Getenv("SPOTMC_DATA_URL"),
+		DataFileURL:        dataFileURL,
+		world:              world,
 		JavaPath:           os.Getenv("SPOTMC_JAVA_PATH"),
 		JavaArgs:           os.Getenv("SPOTMC_JAVA_ARGS"),
 		ddnsURL:            ddnsURL,
@@ -133,6 +608,49 @@ func NewSpotMC() (*SpotMC, error) {
 		shutdownCommand:    shutdownCommand,
 		idleWatchGraceTime: idleWatchGraceTime,
 		idleWatchPath:      idleWatchPath,
+		lockHolder:         lockHolderID(),
+		lockTTL:            lockTTL,
+		notifyURL:          os.Getenv("SPOTMC_NOTIFY_URL"),
+		backupFormat:       backupFormat,
+		chunkStoreURL:      chunkStoreURL,
+		snapshotRetention:  snapshotRetention,
+		compression:        compression,
+		compressionLevel:   compressionLevel,
+		envelope:           env,
+		deadlineMargin:     deadlineMargin,
+		deadlineFallback:   deadlineFallback,
+		mojangManifestURL:  mojangManifestURL,
+		paperAPIURL:        paperAPIURL,
+		cacheURL:           cacheURL,
+		pluginsURL:         os.Getenv("SPOTMC_PLUGINS_URL"),
+		propertyOverrides:  propertyOverrides(os.Environ()),
+		serverPort:         serverPort,
+		rconPort:           rconPort,
+		rconPassword:       os.Getenv("SPOTMC_RCON_PASSWORD"),
+		playersURL:         playersURL,
+		profileLookupURL:   profileLookupURL,
+		playersInterval:    playersInterval,
+		javaRuntimeURL:     javaRuntimeURL,
+		javaRuntimeSHA256:  javaRuntimeSHA256,
+		javaCacheDir:       javaCacheDir,
+		javaMinVersion:     javaMinVersion,
+		javaArgs:           javaArgs,
+		serverCommand:      serverCommand,
+		javaMemory:         javaMemory,
+		memoryHeadroom:     memoryHeadroom,
+		gcPreset:           gcPreset,
+		stopTimeout:        stopTimeout,
+		saveTimeout:        saveTimeout,
+		maxRestarts:        maxRestarts,
+		restartWindow:      restartWindow,
+		restartBackoff:     restartBackoff,
+		crashLogLines:      crashLogLines,
+		crashURL:           crashURL,
+		logDir:             logDir,
+		logsURL:            logsURL,
+		logMaxSize:         logMaxSize,
+		logMaxFiles:        logMaxFiles,
+		logUpload:          logUpload,
 		msgs:               make(chan int),
 	}
 
@@ -146,7 +664,11 @@ func (smc *SpotMC) getJarFile() (serverPath string, err error) {
 	}
 	serverPath = dir + "/server.jar"
 
-	err = S3Get(smc.JarFileURL, serverPath)
+	if isJarSpec(smc.JarFileURL) {
+		err = smc.resolveJar(serverPath)
+	} else {
+		err = S3Get(smc.JarFileURL, serverPath)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -162,55 +684,252 @@ func (smc *SpotMC) getDataDir() (dataDirPath string, err error) {
 		return "", err
 	}
 
-	// Get tgz file and uncompress it to the data dir
-	tgzFile, err := ioutil.TempFile("", "")
+	// Remember which snapshots we started from, see putDataDir()
+	cs := smc.chunkStore()
+	latestID, latestETag, err := cs.latest()
 	if err != nil {
 		return "", err
 	}
-	tgzFile.Close()
-
-	err = S3Get(smc.DataFileURL, tgzFile.Name())
+	tgzETag, err := S3HeadETag(smc.DataFileURL)
 	if err != nil {
-		// Maybe the first time, it's ok.
-		// Populate the data dir with user-provided eula.txt
-		log.WithFields(log.Fields{"url": smc.EULAFileURL}).Info("downloading EULA file")
-		eulaFilePath := dataDirPath + "/eula.txt"
-		err2 := S3Get(smc.EULAFileURL, eulaFilePath)
-		if err2 != nil {
-			log.WithFields(log.Fields{"err": err2}).Error("downloading EULA file failed")
-			return "", err2
-		}
-		log.WithFields(log.Fields{"path": eulaFilePath}).Info("EULA file")
+		return "", err
+	}
+	smc.dataETag = tgzETag
+	smc.chunkETag = latestETag
+
+	// Chunked snapshots are also made as a fallback when the tgz
+	// wouldn't make it before a spot termination, so restore from
+	// whichever is newer.
+	useChunked := false
+	if latestID != "" {
+		useChunked = smc.backupFormat == "chunked" || tgzETag == ""
+		if !useChunked {
+			useChunked, err = smc.chunkedIsNewer(cs, latestID)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	start := time.Now()
+	var n int64
+	smc.chunkedCurrent = useChunked
+	if useChunked {
+		n, err = smc.restoreChunked(cs, latestID, dataDirPath)
+	} else if tgzETag != "" {
+		n, err = smc.restoreTgz(dataDirPath)
 	} else {
-		tgz := extractor.NewTgz()
-		err = tgz.Extract(tgzFile.Name(), dataDirPath)
+		// Maybe the first time, it's ok.
+		log.Info("no saved data, starting with an empty data dir")
+	}
+	if err != nil {
+		return "", err
 	}
+	smc.recordRestore(dataDirPath, n, time.Since(start))
 
 	smc.dataDirPath = dataDirPath
 	return dataDirPath, nil
 }
 
-func (smc *SpotMC) putDataDir() error {
-	// Create a tempfile
-	tgzFile, err := ioutil.TempFile("", "")
+// restoreTgz() streams the archive from S3 and uncompresses it into the data dir.
+// It returns the size of the archive.
+func (smc *SpotMC) restoreTgz(dataDirPath string) (int64, error) {
+	body, etag, err := S3GetStream(smc.DataFileURL)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	tgzFile.Close()
-	defer func() { os.Remove(tgzFile.Name()) }()
+	defer body.Close()
 
-	// Compress dir to tgz
-	tgz := compressor.NewTgz()
-	err = tgz.Compress(smc.dataDirPath+"/", tgzFile.Name())
+	// Verify the archive and the extracted files.
+	// Starting the server on a half-extracted world would
+	// overwrite the good snapshot on the next save.
+	m, err := getManifest(smc.DataFileURL, smc.envelope)
+	if err != nil {
+		return 0, err
+	}
+	if m == nil {
+		log.WithFields(log.Fields{"url": smc.DataFileURL}).Warn("no manifest found, skipping verification")
+	} else if m.stale(etag) {
+		// The archive made it but its manifest didn't, which is
+		// no reason to never start this world again
+		log.WithFields(log.Fields{
+			"url": smc.DataFileURL, "etag": etag, "manifestETag": m.ArchiveETag,
+		}).Warn("manifest is older than the archive, skipping verification")
+		m = nil
+	}
+
+	format := ""
+	if m != nil {
+		format = m.Compression
+	}
+	hc := newHashCounter()
+	r := io.TeeReader(body, hc)
+	dr, err := smc.envelope.decryptReader(r)
+	if err != nil {
+		return 0, err
+	}
+	err = archiver.Extract(dr, dataDirPath, archiver.Options{
+		Compression: format,
+		Progress:    archiveProgress("extracting data"),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("extracting data failed: %s", err)
+	}
+	// Read the rest (tar padding, the final encrypted segment) so that
+	// the whole object is authenticated and hashed
+	_, err = io.Copy(ioutil.Discard, dr)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return 0, err
+	}
+
+	if m != nil {
+		err = m.verifyArchive(hc)
+		if err != nil {
+			return 0, err
+		}
+		err = m.verifyDir(dataDirPath)
+		if err != nil {
+			return 0, err
+		}
+		log.WithFields(log.Fields{
+			"files": m.FileCount, "serverVersion": m.ServerVersion, "createdAt": m.CreatedAt,
+		}).Info("data directory verified")
+	}
+	return hc.n, nil
+}
+
+// putDataDir() saves dir, the data dir or a copy of it, with the
+// configured format, or with a quicker strategy if a spot termination
+// is coming, see saveStrategy().
+func (smc *SpotMC) putDataDir(dir string) error {
+	// Refuse to overwrite the data if another instance owns it now
+	err := smc.checkLock()
 	if err != nil {
 		return err
 	}
 
-	// Put tgz to S3
-	err = S3Put(smc.DataFileURL, tgzFile.Name())
+	strategy, estimate := smc.saveStrategy(dir)
+	start := time.Now()
+	var n int64
+	switch strategy {
+	case saveIncremental:
+		n, err = smc.putChunkedDataDir(dir)
+	case saveFast:
+		n, err = smc.putTgzDataDir(dir, "none", -1)
+	default:
+		if smc.backupFormat == "chunked" {
+			n, err = smc.putChunkedDataDir(dir)
+		} else {
+			n, err = smc.putTgzDataDir(dir, smc.compression, smc.compressionLevel)
+		}
+	}
+	elapsed := time.Since(start)
+	if err == nil {
+		smc.recordThroughput(n, elapsed)
+	}
+	smc.reportSave(strategy, estimate, elapsed, err)
 	return err
 }
 
+// putTgzDataDir() saves dir as a single archive and returns its size.
+func (smc *SpotMC) putTgzDataDir(dir, compression string, level int) (int64, error) {
+	// S3 can't do conditional writes, so compare the ETag of the
+	// current snapshot with the one we restored right before replacing it.
+	// If someone else saved in the meantime, keep both worlds.
+	url := smc.DataFileURL
+	remoteETag, err := S3HeadETag(smc.DataFileURL)
+	if err != nil {
+		return 0, err
+	}
+	conflict := remoteETag != smc.dataETag
+	if conflict {
+		url = smc.conflictURL()
+	}
+
+	m, etag, err := smc.streamDataDir(dir, url, compression, level)
+	if err != nil {
+		return 0, err
+	}
+	err = putManifest(url, m, smc.envelope)
+	if err != nil {
+		return 0, err
+	}
+
+	if conflict {
+		smc.notify("save-conflict", "world data was changed by someone else, saved as a conflict snapshot", log.Fields{
+			"url":          url,
+			"restoredETag": smc.dataETag,
+			"remoteETag":   remoteETag,
+		})
+		return 0, errSaveConflict
+	}
+	smc.dataETag = etag
+	return m.ArchiveSize, nil
+}
+
+// streamDataDir() archives, compresses and encrypts dir straight into a multipart upload,
+// without a temp file, and returns the manifest of what it uploaded.
+func (smc *SpotMC) streamDataDir(dir, url, compression string, level int) (*manifest, string, error) {
+	pr, pw := io.Pipe()
+	hc := newHashCounter()
+	filesCh := make(chan map[string]string, 1)
+	go func() {
+		var files map[string]string
+		ew, err := smc.envelope.encryptWriter(io.MultiWriter(pw, hc))
+		if err == nil {
+			files, err = archiver.Write(ew, dir, archiver.Options{
+				Compression: compression,
+				Level:       level,
+				Filter:      smc.archiveFilter(),
+				Progress:    archiveProgress("archiving data"),
+				Warn:        archiveWarning,
+			})
+		}
+		if err == nil {
+			err = ew.Close()
+		}
+		filesCh <- files
+		pw.CloseWithError(err)
+	}()
+
+	etag, err := S3PutStream(url, pr)
+	// Unblock the archiver if the upload gave up early
+	pr.CloseWithError(fmt.Errorf("upload aborted"))
+	files := <-filesCh
+	if err != nil {
+		return nil, "", err
+	}
+
+	m := newManifest(files, hc, compression, smc.serverVersion())
+	m.World = smc.world
+	m.ArchiveETag = etag
+	return m, etag, nil
+}
+
+func (smc *SpotMC) conflictURL() string {
+	return fmt.Sprintf("%s.conflict-%s", smc.DataFileURL, time.Now().UTC().Format("20060102T150405Z"))
+}
+
+// serverVersion() tells which game server the data is saved with.
+// For now it's the file name of the server jar or the server download,
+// or the resolved release, like "paper-1.20.4-435.jar".
+func (smc *SpotMC) serverVersion() string {
+	if smc.serverName != "" {
+		return smc.serverName
+	}
+	if smc.JarFileURL == "" && smc.serverURL != "" {
+		return path.Base(smc.serverURL)
+	}
+	if smc.JarFileURL == "" {
+		return smc.game
+	}
+	return path.Base(smc.JarFileURL)
+}
+
 func (smc *SpotMC) updateDDNS() {
 	if smc.ddnsURL != "" {
 		log.Info("Issuing DDNS query")
@@ -224,23 +943,54 @@ func (smc *SpotMC) updateDDNS() {
 	}
 }
 
-func (smc *SpotMC) startServer() (exec.Cmd, error) {
-	args := []string{smc.JavaPath}
-	if smc.JavaArgs != "" {
-		extraArgs := strings.Split(smc.JavaArgs, " ")
-		args = append(args, extraArgs...)
+// startServer() starts the game server with its console on a pipe,
+// see consoleCommand(). Its output is also written to tail.
+// The command line is SPOTMC_SERVER_COMMAND, see commandValues().
+func (smc *SpotMC) startServer(tail *logTail) (*exec.Cmd, error) {
+	memoryArgs, err := smc.memoryArgs()
+	if err != nil {
+		return nil, err
+	}
+	args, err := expandCommand(smc.serverCommand, smc.commandValues(memoryArgs))
+	if err != nil {
+		return nil, err
+	}
+	path := args[0]
+	if !strings.Contains(path, "/") {
+		path, err = exec.LookPath(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var env []string
+	if smc.profile != nil && len(smc.profile.Env) > 0 {
+		env = append(os.Environ(), smc.profile.Env...)
 	}
-	args = append(args, "-jar", smc.serverPath, "nogui")
 
-	cmd := exec.Cmd{
-		Path: args[0],
-		Args: args,
-		Dir:  smc.dataDirPath,
-		//Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+	stdout, stderr := serverOutput(tail, smc.consoleLog)
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   args,
+		Dir:    smc.dataDirPath,
+		Env:    env,
+		Stdout: stdout,
+		Stderr: stderr,
+		// Keep a Ctrl-C on the terminal away from the game server,
+		// spotmc stops it itself
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	console, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err == nil {
+		smc.mu.Lock()
+		smc.cmd = cmd
+		smc.console = console
+		smc.mu.Unlock()
 	}
-	err := cmd.Start()
 
 	log.WithFields(log.Fields{
 		"cmd": args[0], "args": args, "len": len(args), "err": err,
@@ -250,17 +1000,20 @@ func (smc *SpotMC) startServer() (exec.Cmd, error) {
 }
 
 func (smc *SpotMC) killInstance() error {
+	smc.mu.Lock()
+	killInstanceMode, shutdownCommand := smc.killInstanceMode, smc.shutdownCommand
+	smc.mu.Unlock()
 	log.WithFields(log.Fields{
-		"killInstanceMode": smc.killInstanceMode,
+		"killInstanceMode": killInstanceMode,
 	}).Info("killInstance invoked")
 
-	if smc.killInstanceMode == "false" {
+	if killInstanceMode == "false" {
 		// False mode. Don't do anything
 		return nil
 	}
 
-	if smc.killInstanceMode == "shutdown" {
-		cmdArgs := strings.Split(smc.shutdownCommand, " ")
+	if killInstanceMode == "shutdown" {
+		cmdArgs := strings.Split(shutdownCommand, " ")
 		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
 		err := cmd.Run()
 		return err
@@ -292,30 +1045,51 @@ func (smc *SpotMC) shutdownCluster() error {
 
 // uptimeWatcher() shutdowns the *cluster* when
 // the process uptime exceeds the predefined limit (smc.maxUptime).
+// The limit is read every minute, so a reload can extend it.
 func (smc *SpotMC) uptimeWatcher() {
-	logFields := log.Fields{"maxUptime": smc.maxUptime}
-	log.WithFields(logFields).Info("uptimeWatcher starting")
+	start := time.Now()
+	log.WithFields(log.Fields{"maxUptime": smc.maxUptime}).Info("uptimeWatcher starting")
 
-	d := time.Duration(smc.maxUptime) * time.Second
-	time.Sleep(d)
-
-	log.WithFields(logFields).Info("uptime exceeded limit, shutdown the cluster")
+	for {
+		time.Sleep(time.Minute)
+		smc.mu.Lock()
+		maxUptime := smc.maxUptime
+		smc.mu.Unlock()
+		if time.Since(start) > time.Duration(maxUptime)*time.Second {
+			log.WithFields(log.Fields{"maxUptime": maxUptime}).Info("uptime exceeded limit, shutdown the cluster")
+			break
+		}
+	}
 	smc.msgs <- msgShutdownCluster
 }
 
 // idleWatcher() shutdowns the *cluster* when
 // there's a long idle time (smc.maxIdleTime).
+// Games which can count their players are asked, for the others
+// the mtime of smc.idleWatchPath tells when someone last played.
 func (smc *SpotMC) idleWatcher() {
+	if smc.profile.Players == nil && smc.idleWatchPath == "" {
+		log.Info("no way to tell the players of this game, idle watcher disabled")
+		return
+	}
 	grace := time.Duration(smc.idleWatchGraceTime) * time.Second
 	log.Infof("idle watcher starts after %.2f mins", grace.Minutes())
 	time.Sleep(grace) // Wait for a grace period
 
-	fullPath := smc.dataDirPath + "/" + smc.idleWatchPath
-	d := time.Duration(smc.maxIdleTime) * time.Second
+	if smc.profile.Players != nil {
+		smc.playerCountWatcher()
+		return
+	}
 
-	log.WithFields(log.Fields{"idleWatchPath": fullPath, "maxIdleTime": smc.maxIdleTime}).Info("idle watcher starting")
+	log.WithFields(log.Fields{"idleWatchPath": smc.idleWatchPath, "maxIdleTime": smc.maxIdleTime}).Info("idle watcher starting")
 
 	for true {
+		// Reloadable
+		smc.mu.Lock()
+		fullPath := smc.dataDirPath + "/" + smc.idleWatchPath
+		d := time.Duration(smc.maxIdleTime) * time.Second
+		smc.mu.Unlock()
+
 		time.Sleep(d / 12)
 		fi, err := os.Stat(fullPath)
 		if err != nil {
@@ -334,6 +1108,34 @@ func (smc *SpotMC) idleWatcher() {
 	smc.msgs <- msgShutdownCluster
 }
 
+// playerCountWatcher() is idleWatcher() for games which can count
+// their players.
+func (smc *SpotMC) playerCountWatcher() {
+	log.WithFields(log.Fields{"maxIdleTime": smc.maxIdleTime}).Info("idle watcher starting")
+	lastSeen := time.Now()
+	for {
+		smc.mu.Lock()
+		d := time.Duration(smc.maxIdleTime) * time.Second
+		smc.mu.Unlock()
+
+		time.Sleep(d / 12)
+		n, err := smc.profile.Players(smc)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("counting players failed")
+			continue
+		}
+		if n > 0 {
+			lastSeen = time.Now()
+		}
+		log.Infof("players: %d, idle: %.2f minutes", n, time.Since(lastSeen).Minutes())
+		if time.Since(lastSeen) > d {
+			log.Infof("idle time exceeded limit, shutdown the cluster")
+			break
+		}
+	}
+	smc.msgs <- msgShutdownCluster
+}
+
 // terminationNotificationWatcher() accesses EC2 meta-data and
 // watches spot instance shutdown notification.
 // It sends a message to kill the game server and save data before
@@ -343,17 +1145,31 @@ func (smc *SpotMC) terminationNotificationWatcher() {
 	for {
 		time.Sleep(d)
 		resp, err := http.Get(TERMINATION_TIME_URL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url": TERMINATION_TIME_URL,
+				"err": err,
+			}).Debug("termination check failed")
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		log.WithFields(log.Fields{
 			"url":    TERMINATION_TIME_URL,
 			"status": resp.StatusCode,
-			"err":    err,
 		}).Debug("termination check result")
 		// 404 means termination is not scheduled,
 		// 200 means termination is scheduled
 		if resp.StatusCode == 200 {
+			// The body is the termination time, about 2 minutes ahead
+			deadline, err := time.Parse(time.RFC3339, strings.TrimSpace(string(body)))
+			if err != nil {
+				deadline = time.Now().Add(TERMINATION_NOTICE_TIME)
+			}
+			smc.setDeadline(deadline)
 			log.WithFields(log.Fields{
-				"status": resp.StatusCode,
+				"status":   resp.StatusCode,
+				"deadline": deadline,
 			}).Info("termination schedule detected, kill this instance beforehand")
 			smc.msgs <- msgInstanceTerminating
 			break
@@ -4,9 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"github.com/goura/spotmc"
+	"os"
 )
 
-var flagInitscript = flag.Bool("rhinitscript", false, "generate dummy initscript")
+var flagInitscript = flag.Bool("rhinitscript", false, "generate dummy initscript (deprecated, use systemd-unit)")
 
 func main() {
 	flag.Parse()
@@ -17,7 +18,103 @@ func main() {
 			panic(err)
 		}
 		fmt.Print(string(data))
-	} else {
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "force-unlock":
+		// remove a stale world data lock left by a dead instance
+		fs := flag.NewFlagSet("force-unlock", flag.ExitOnError)
+		world := fs.String("world", "", "world to unlock, SPOTMC_WORLD if empty")
+		fs.Parse(flag.Args()[1:])
+		err := spotmc.ForceUnlock(*world)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "players":
+		// edit the whitelist, ops and bans kept in S3
+		err := spotmc.PlayersCommand(flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "archive-dry-run":
+		// list what saving a data dir would archive
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "usage: spotmc archive-dry-run <data dir>")
+			os.Exit(2)
+		}
+		err := spotmc.ArchiveDryRun(flag.Arg(1), os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "logs":
+		// list and fetch the logs uploaded by each session
+		err := spotmc.LogsCommand(flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "cluster":
+		// start or stop the server through its autoscaling group
+		cluster(flag.Args()[1:])
+	case "systemd-unit":
+		// output a systemd service unit and exit
+		systemdUnit(flag.Args()[1:])
+	default:
 		spotmc.Main()
 	}
 }
+
+func cluster(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: spotmc cluster up|down|worlds [-group name] [-world name]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	group := fs.String("group", os.Getenv("SPOTMC_AUTOSCALING_GROUP"), "name of the autoscaling group")
+	world := fs.String("world", "", "world to launch, the last one if empty")
+	fs.Parse(args[1:])
+	if args[0] != "worlds" && *group == "" {
+		fmt.Fprintln(os.Stderr, "set -group or SPOTMC_AUTOSCALING_GROUP")
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "up":
+		err = spotmc.ClusterUp(*group, *world)
+	case "down":
+		err = spotmc.ClusterDown(*group)
+	case "worlds":
+		var worlds []string
+		worlds, err = spotmc.ListWorlds()
+		for _, w := range worlds {
+			fmt.Println(w)
+		}
+	default:
+		err = fmt.Errorf("unknown cluster command: %s", args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func systemdUnit(args []string) {
+	c := spotmc.DefaultSystemdUnitConfig
+	fs := flag.NewFlagSet("systemd-unit", flag.ExitOnError)
+	fs.StringVar(&c.ExecPath, "exec", c.ExecPath, "path to the spotmc binary")
+	fs.StringVar(&c.EnvironmentFile, "env", c.EnvironmentFile, "file with the SPOTMC_* settings")
+	fs.IntVar(&c.TimeoutStopSec, "timeout", c.TimeoutStopSec, "seconds to let spotmc save before being killed")
+	fs.IntVar(&c.WatchdogSec, "watchdog", c.WatchdogSec, "watchdog interval in seconds, 0 to disable")
+	fs.Parse(args)
+
+	err := spotmc.WriteSystemdUnit(os.Stdout, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
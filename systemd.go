@@ -0,0 +1,164 @@
+package spotmc
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// SystemdUnitConfig holds the parameters of the generated service unit.
+type SystemdUnitConfig struct {
+	ExecPath        string
+	EnvironmentFile string
+	TimeoutStopSec  int
+	WatchdogSec     int
+}
+
+var DefaultSystemdUnitConfig = SystemdUnitConfig{
+	ExecPath:        "/spotmc",
+	EnvironmentFile: "/etc/spotmc.conf",
+	// A spot termination notice comes 2 minutes ahead
+	TimeoutStopSec: 110,
+	WatchdogSec:    60,
+}
+
+// The unit is ordered after network-online.target, so on shutdown it is
+// stopped (and spotmc finishes saving) before the network goes down.
+// KillMode=mixed sends SIGTERM to spotmc only; it stops the game server
+// itself, and whatever is left is killed after TimeoutStopSec.
+// Restoring a large world takes a while, so there's no start timeout.
+// A reload makes spotmc re-read the environment file.
+var systemdUnitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=SpotMC game server
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+EnvironmentFile={{.EnvironmentFile}}
+Environment=SPOTMC_CONFIG_FILE={{.EnvironmentFile}}
+ExecStart={{.ExecPath}}
+ExecReload=/bin/kill -HUP $MAINPID
+TimeoutStartSec=0
+KillMode=mixed
+KillSignal=SIGTERM
+TimeoutStopSec={{.TimeoutStopSec}}
+{{if .WatchdogSec}}WatchdogSec={{.WatchdogSec}}
+{{end}}Restart=no
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// WriteSystemdUnit writes a systemd service unit which runs spotmc.
+func WriteSystemdUnit(w io.Writer, c SystemdUnitConfig) error {
+	return systemdUnitTemplate.Execute(w, c)
+}
+
+// sdNotify sends a state like "READY=1" to systemd.
+// It does nothing if spotmc isn't run by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping,
+// or zero if the watchdog isn't enabled for us.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog() pings the systemd watchdog while spotmc is healthy, that is
+// while the game server process is alive, being restarted after a crash,
+// or spotmc is stopping and saving.
+// It pings twice per interval and only skips a ping when the check fails,
+// so a check which falls between the server exiting and the main loop
+// reacting to it doesn't get spotmc killed. If the server stays down
+// without spotmc noticing, the pings stop and systemd steps in.
+func (smc *SpotMC) watchdog() {
+	d := watchdogInterval()
+	if d == 0 {
+		return
+	}
+	log.WithFields(log.Fields{"interval": d.Seconds()}).Info("systemd watchdog enabled")
+
+	for {
+		time.Sleep(d / 2)
+		if !smc.alive() {
+			log.Warn("game server is not alive, skipping a watchdog ping")
+			continue
+		}
+		err := sdNotify("WATCHDOG=1")
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("pinging systemd watchdog failed")
+		}
+	}
+}
+
+func (smc *SpotMC) alive() bool {
+	if atomic.LoadInt32(&smc.stopping) != 0 || atomic.LoadInt32(&smc.restarting) != 0 {
+		return true
+	}
+	pid := int(atomic.LoadInt32(&smc.serverPid))
+	if pid == 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// status() is the STATUS line shown by "systemctl status", which tells
+// the world with SPOTMC_WORLDS_URL.
+func (smc *SpotMC) status(s string) string {
+	if smc.world != "" {
+		s += " (world " + smc.world + ")"
+	}
+	return "STATUS=" + s
+}
+
+// serverReady() tells systemd the game server accepts players.
+func (smc *SpotMC) serverReady() {
+	log.Info("game server is ready")
+	if smc.readyPattern != nil {
+		// The game server has read server.properties by now
+		err := smc.setRconPassword(false)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("removing rcon.password from server.properties failed")
+		}
+	}
+	sdNotify("READY=1\n" + smc.status("game server running"))
+}
+
+// setStopping() marks spotmc as stopping and tells systemd so.
+func (smc *SpotMC) setStopping(status string) {
+	atomic.StoreInt32(&smc.stopping, 1)
+	sdNotify("STOPPING=1\n" + smc.status(status))
+}
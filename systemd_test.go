@@ -0,0 +1,136 @@
+package spotmc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteSystemdUnit(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteSystemdUnit(&buf, DefaultSystemdUnitConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := buf.String()
+	for _, line := range []string{
+		"Type=notify",
+		"EnvironmentFile=/etc/spotmc.conf",
+		"Environment=SPOTMC_CONFIG_FILE=/etc/spotmc.conf",
+		"ExecStart=/spotmc",
+		"KillMode=mixed",
+		"TimeoutStopSec=110",
+		"WatchdogSec=60",
+		"After=network-online.target",
+	} {
+		if !strings.Contains(unit, line+"\n") {
+			t.Errorf("%q is missing from\n%s", line, unit)
+		}
+	}
+
+	buf.Reset()
+	c := DefaultSystemdUnitConfig
+	c.WatchdogSec = 0
+	WriteSystemdUnit(&buf, c)
+	if strings.Contains(buf.String(), "WatchdogSec") {
+		t.Errorf("WatchdogSec is set when disabled:\n%s", buf.String())
+	}
+}
+
+func TestAlive(t *testing.T) {
+	smc := &SpotMC{}
+	if smc.alive() {
+		t.Error("alive without a game server")
+	}
+	atomic.StoreInt32(&smc.serverPid, int32(os.Getpid()))
+	if !smc.alive() {
+		t.Error("not alive with a running game server")
+	}
+	// A pid which can't exist
+	atomic.StoreInt32(&smc.serverPid, 1<<30)
+	if smc.alive() {
+		t.Error("alive with a dead game server")
+	}
+	atomic.StoreInt32(&smc.serverPid, 0)
+	atomic.StoreInt32(&smc.restarting, 1)
+	if !smc.alive() {
+		t.Error("not alive while restarting")
+	}
+	atomic.StoreInt32(&smc.restarting, 0)
+	atomic.StoreInt32(&smc.stopping, 1)
+	if !smc.alive() {
+		t.Error("not alive while stopping")
+	}
+}
+
+func TestWatchdogSkipsPings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	// The game server is down for a moment and back
+	smc := &SpotMC{}
+	go smc.watchdog()
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&smc.serverPid, int32(os.Getpid()))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("no watchdog ping after the game server came back", err)
+	}
+	if string(buf[:n]) != "WATCHDOG=1" {
+		t.Errorf("got %q", buf[:n])
+	}
+}
+
+func TestStatusWorld(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	smc := &SpotMC{world: "creative"}
+	smc.setStopping("saving data")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 128)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "STOPPING=1\nSTATUS=saving data (world creative)" {
+		t.Errorf("got %q", buf[:n])
+	}
+
+	if s := (&SpotMC{}).status("game server running"); s != "STATUS=game server running" {
+		t.Errorf("got %q without a world", s)
+	}
+}
@@ -0,0 +1,173 @@
+package spotmc
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/autoscaling"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var DEFAULT_WORLD = "default"
+var WORLD_DATA_FILE = "data.tgz"
+
+// The autoscaling group tag which selects the world to launch
+var WORLD_TAG = "spotmc:world"
+
+var worldNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// worldDataURL returns where the data is saved. Without SPOTMC_WORLDS_URL
+// it's SPOTMC_DATA_URL. With it, each world has its own directory like
+// "s3://bucket/worlds/creative/data.tgz", and the world is the one given,
+// or SPOTMC_WORLD, or "default".
+func worldDataURL(world string) (dataURL, name string, err error) {
+	worldsURL := os.Getenv("SPOTMC_WORLDS_URL")
+	if worldsURL == "" {
+		return os.Getenv("SPOTMC_DATA_URL"), "", nil
+	}
+	if world == "" {
+		world = os.Getenv("SPOTMC_WORLD")
+	}
+	if world == "" {
+		world = DEFAULT_WORLD
+	}
+	if !worldNamePattern.MatchString(world) {
+		return "", "", fmt.Errorf("invalid world name: %q", world)
+	}
+	return worldsPrefix(worldsURL) + world + "/" + WORLD_DATA_FILE, world, nil
+}
+
+func worldsPrefix(worldsURL string) string {
+	return strings.TrimSuffix(worldsURL, "/") + "/"
+}
+
+// sharedURL returns the prefix of what all worlds share, like the jar
+// cache and the player lists. Their names start with a dot, which keeps
+// them apart from the worlds.
+func sharedURL(dataFileURL string) string {
+	if worldsURL := os.Getenv("SPOTMC_WORLDS_URL"); worldsURL != "" {
+		return worldsPrefix(worldsURL)
+	}
+	return dataFileURL
+}
+
+// worldFromTag() returns the world set on the autoscaling group of this
+// instance by "spotmc cluster up -world", or "" if there's none.
+func worldFromTag() (string, error) {
+	instanceID, err := InstanceID()
+	if err != nil {
+		return "", err
+	}
+	asCli := autoScalingClient()
+	out, err := asCli.DescribeAutoScalingInstances(&autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIDs: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.AutoScalingInstances) == 0 {
+		// Not in an autoscaling group
+		return "", nil
+	}
+	group := stringValue(out.AutoScalingInstances[0].AutoScalingGroupName)
+
+	tags, err := asCli.DescribeTags(&autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{Name: aws.String("auto-scaling-group"), Values: []*string{aws.String(group)}},
+			{Name: aws.String("key"), Values: []*string{aws.String(WORLD_TAG)}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tags.Tags {
+		if stringValue(t.Key) == WORLD_TAG {
+			return stringValue(t.Value), nil
+		}
+	}
+	return "", nil
+}
+
+// selectWorld() switches to the world tagged on the autoscaling group,
+// which takes precedence over SPOTMC_WORLD.
+func selectWorld(smc *SpotMC) (*SpotMC, error) {
+	if os.Getenv("SPOTMC_WORLDS_URL") == "" {
+		return smc, nil
+	}
+	world, err := worldFromTag()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("reading the world tag failed, using SPOTMC_WORLD")
+		return smc, nil
+	}
+	if world == "" || world == smc.world {
+		return smc, nil
+	}
+	log.WithFields(log.Fields{"world": world, "tag": WORLD_TAG}).Info("world selected by the autoscaling group tag")
+	return newSpotMC(world)
+}
+
+// ListWorlds returns the worlds under SPOTMC_WORLDS_URL.
+func ListWorlds() ([]string, error) {
+	worldsURL := os.Getenv("SPOTMC_WORLDS_URL")
+	if worldsURL == "" {
+		return nil, fmt.Errorf("set SPOTMC_WORLDS_URL")
+	}
+	keys, err := S3List(worldsPrefix(worldsURL))
+	if err != nil {
+		return nil, err
+	}
+	// A world saved only in the chunked format has just its chunk store
+	seen := map[string]bool{}
+	var worlds []string
+	for _, k := range keys {
+		parts := strings.SplitN(k, "/", 2)
+		if len(parts) != 2 || seen[parts[0]] || !worldNamePattern.MatchString(parts[0]) {
+			continue
+		}
+		if parts[1] == WORLD_DATA_FILE || strings.HasPrefix(parts[1], WORLD_DATA_FILE+CHUNK_STORE_SUFFIX) {
+			seen[parts[0]] = true
+			worlds = append(worlds, parts[0])
+		}
+	}
+	return worlds, nil
+}
+
+// ClusterUp launches the server of the autoscaling group, with the world
+// if given.
+func ClusterUp(group, world string) error {
+	asCli := autoScalingClient()
+	if world != "" {
+		if !worldNamePattern.MatchString(world) {
+			return fmt.Errorf("invalid world name: %q", world)
+		}
+		_, err := asCli.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{
+			Tags: []*autoscaling.Tag{{
+				Key:               aws.String(WORLD_TAG),
+				Value:             aws.String(world),
+				ResourceID:        aws.String(group),
+				ResourceType:      aws.String("auto-scaling-group"),
+				PropagateAtLaunch: aws.Boolean(false),
+			}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := asCli.UpdateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(group),
+		DesiredCapacity:      aws.Long(1),
+	})
+	return err
+}
+
+// ClusterDown stops the server of the autoscaling group. spotmc saves
+// the data before the instance goes away.
+func ClusterDown(group string) error {
+	_, err := autoScalingClient().UpdateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(group),
+		DesiredCapacity:      aws.Long(0),
+	})
+	return err
+}
@@ -0,0 +1,71 @@
+package spotmc
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWorldDataURL(t *testing.T) {
+	os.Setenv("SPOTMC_DATA_URL", "s3://bucket/data.tgz")
+	os.Setenv("SPOTMC_WORLDS_URL", "")
+	os.Setenv("SPOTMC_WORLD", "")
+	defer os.Unsetenv("SPOTMC_DATA_URL")
+	defer os.Unsetenv("SPOTMC_WORLDS_URL")
+	defer os.Unsetenv("SPOTMC_WORLD")
+
+	url, world, err := worldDataURL("")
+	if err != nil || url != "s3://bucket/data.tgz" || world != "" {
+		t.Errorf("got %q, %q, %v", url, world, err)
+	}
+
+	os.Setenv("SPOTMC_WORLDS_URL", "s3://bucket/worlds")
+	url, world, err = worldDataURL("")
+	if err != nil || url != "s3://bucket/worlds/default/data.tgz" || world != "default" {
+		t.Errorf("got %q, %q, %v", url, world, err)
+	}
+	os.Setenv("SPOTMC_WORLD", "survival")
+	url, world, err = worldDataURL("")
+	if err != nil || url != "s3://bucket/worlds/survival/data.tgz" || world != "survival" {
+		t.Errorf("got %q, %q, %v", url, world, err)
+	}
+	url, world, err = worldDataURL("creative")
+	if err != nil || url != "s3://bucket/worlds/creative/data.tgz" || world != "creative" {
+		t.Errorf("got %q, %q, %v", url, world, err)
+	}
+	if u := sharedURL(url); u != "s3://bucket/worlds/" {
+		t.Errorf("got %q", u)
+	}
+	for _, w := range []string{"../other", ".cache", "Creative"} {
+		_, _, err = worldDataURL(w)
+		if err == nil {
+			t.Errorf("%q: expected an error", w)
+		}
+	}
+}
+
+func TestListWorlds(t *testing.T) {
+	fake, restore := useFakeS3()
+	defer restore()
+	os.Setenv("SPOTMC_WORLDS_URL", "s3://bucket/worlds")
+	defer os.Unsetenv("SPOTMC_WORLDS_URL")
+	for _, k := range []string{
+		"survival/data.tgz",
+		"survival/data.tgz.manifest.json",
+		"survival/data.tgz.store/latest",
+		"creative/data.tgz.store/latest",
+		"creative/data.tgz.store/chunks/abc",
+		".cache/jars/server.jar",
+		".cache/plugins/abc",
+		"Invalid/data.tgz",
+		".players.json",
+	} {
+		fake.put("s3://bucket/worlds/"+k, "x")
+	}
+	worlds, err := ListWorlds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(worlds) != 2 || worlds[0] != "creative" || worlds[1] != "survival" {
+		t.Errorf("got %v", worlds)
+	}
+}